@@ -0,0 +1,84 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/msanatan/go-chatroom/app/models"
+	"github.com/msanatan/go-chatroom/app/service"
+	log "github.com/sirupsen/logrus"
+)
+
+// runExport is the export subcommand. It saves the history of the rooms with the given
+// slugs, or of every room when there are none, to a file per room
+func runExport(args []string, dbClient *models.ChatroomDB, logger *log.Entry) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := flags.String("format", service.ExportJSON, "file format: json, csv or txt")
+	from := flags.String("from", "", "only export messages sent from this date, like 2021-03-14")
+	to := flags.String("to", "", "only export messages sent up to this date, like 2021-03-14")
+	out := flags.String("out", ".", "directory to save the files in")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	options, err := service.ParseExportOptions(*format, *from, *to)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(*out, 0755)
+	if err != nil {
+		return err
+	}
+
+	var rooms []models.Room
+	tx := dbClient.DB.Order("id asc")
+	if flags.NArg() > 0 {
+		slugs := make([]string, flags.NArg())
+		for i, slug := range flags.Args() {
+			slugs[i] = strings.ToLower(slug)
+		}
+		tx = tx.Where("slug IN ?", slugs)
+	}
+
+	err = tx.Find(&rooms).Error
+	if err != nil {
+		return err
+	}
+
+	if flags.NArg() > 0 && len(rooms) < flags.NArg() {
+		return fmt.Errorf("only found %d of the %d rooms to export", len(rooms), flags.NArg())
+	}
+
+	for _, room := range rooms {
+		path := filepath.Join(*out, service.ExportFilename(room, options.Format))
+		err = exportToFile(dbClient, path, room, options)
+		if err != nil {
+			return fmt.Errorf("could not export %s: %s", room.Name, err.Error())
+		}
+
+		logger.Infof("exported %s to %s", room.Name, path)
+	}
+
+	return nil
+}
+
+// exportToFile saves one room's history to a file, replacing what was there
+func exportToFile(dbClient *models.ChatroomDB, path string, room models.Room, options service.ExportOptions) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	err = service.ExportRoom(dbClient.DB, file, room, options)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"os"
+
+	"github.com/msanatan/go-chatroom/app/models"
+	"github.com/msanatan/go-chatroom/app/service"
+	log "github.com/sirupsen/logrus"
+)
+
+// runImport is the import subcommand. It loads archives from other tools, one file after the other
+func runImport(files []string, dbClient *models.ChatroomDB, logger *log.Entry) error {
+	for _, path := range files {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+
+		result, err := service.ImportArchive(dbClient.DB, file)
+		file.Close()
+		if err != nil {
+			return err
+		}
+
+		logger.Infof("imported %s: %d users and %d rooms created, %d messages imported and %d already there",
+			path, result.UsersCreated, result.RoomsCreated, result.MessagesImported, result.MessagesSkipped)
+	}
+
+	return nil
+}
@@ -13,6 +13,7 @@ import (
 	_ "github.com/lib/pq"
 	"github.com/msanatan/go-chatroom/app/models"
 	"github.com/msanatan/go-chatroom/app/service"
+	"github.com/msanatan/go-chatroom/app/storage"
 	"github.com/msanatan/go-chatroom/rabbitmq"
 	"github.com/msanatan/go-chatroom/utils"
 	"github.com/streadway/amqp"
@@ -55,6 +56,24 @@ func main() {
 		logger.Fatalf("could not complete DB migrations: %s", err.Error())
 	}
 
+	// Admins export room histories with "chatroom export [flags] [room slugs...]"
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		err = runExport(os.Args[2:], dbClient, logger)
+		if err != nil {
+			logger.Fatalf("could not export rooms: %s", err.Error())
+		}
+		return
+	}
+
+	// and import archives from other tools with "chatroom import [archive files...]"
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		err = runImport(os.Args[2:], dbClient, logger)
+		if err != nil {
+			logger.Fatalf("could not import archives: %s", err.Error())
+		}
+		return
+	}
+
 	rabbitConnection := os.Getenv("RABBITMQ_CONNECTION")
 	if rabbitConnection == "" {
 		logger.Error("No RabbitMQ connection string provided, will not setup connection")
@@ -83,8 +102,45 @@ func main() {
 		logger.Fatalf("Missing JWT_SECRET env var")
 	}
 
-	wsServer = service.NewServer(rabbitMQClient, dbClient, jwtSecret, "/", logger)
+	// Messages are kept forever unless a retention policy is set, for the whole site here or per room
+	retention, err := service.ParseRetentionPolicy(os.Getenv("RETENTION_DAYS"),
+		os.Getenv("RETENTION_MESSAGES"), os.Getenv("RETENTION_MODE"))
+	if err != nil {
+		logger.Fatalf("retention policy is not valid: %s", err.Error())
+	}
+
+	retentionInterval := time.Hour
+	if intervalString := os.Getenv("RETENTION_INTERVAL"); intervalString != "" {
+		retentionInterval, err = time.ParseDuration(intervalString)
+		if err != nil || retentionInterval <= 0 {
+			logger.Fatalf("%s is not a valid retention interval", intervalString)
+		}
+	}
+
+	// Shared files are kept on disk, unless an S3 compatible bucket is configured
+	var fileStorage storage.Storage
+	if bucket := os.Getenv("S3_BUCKET"); bucket != "" {
+		fileStorage, err = storage.NewS3Storage(storage.S3Config{
+			Endpoint:        os.Getenv("S3_ENDPOINT"),
+			Region:          os.Getenv("S3_REGION"),
+			Bucket:          bucket,
+			AccessKeyID:     os.Getenv("S3_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+		})
+	} else {
+		uploadsDir := os.Getenv("UPLOADS_DIR")
+		if uploadsDir == "" {
+			uploadsDir = "./uploads/"
+		}
+		fileStorage, err = storage.NewLocalStorage(uploadsDir)
+	}
+	if err != nil {
+		logger.Fatalf("could not set up file storage: %s", err.Error())
+	}
+
+	wsServer = service.NewServer(rabbitMQClient, dbClient, fileStorage, jwtSecret, "/", logger)
 	go wsServer.Run()
+	go service.NewJanitor(dbClient, fileStorage, retention, retentionInterval, logger).Run()
 	if rabbitMQClient != nil {
 		go wsServer.ConsumeRMQ()
 	}
@@ -108,10 +164,44 @@ func main() {
 
 	protected := r.PathPrefix("/api").Subrouter()
 	protected.HandleFunc("/rooms/{roomId}/messages", wsServer.GetLastMessages).Methods("GET")
+	protected.HandleFunc("/rooms/{roomId}/presence", wsServer.GetPresence).Methods("GET")
+	protected.HandleFunc("/rooms/{roomId}/read", wsServer.MarkRoomRead).Methods("POST")
+	protected.HandleFunc("/rooms/{roomId}/pins", wsServer.GetPins).Methods("GET")
+	protected.HandleFunc("/rooms/{roomId}/export", wsServer.ExportRoomHistory).Methods("GET")
 	protected.HandleFunc("/rooms", wsServer.GetRooms).Methods("GET")
 	protected.HandleFunc("/rooms", wsServer.CreateRoom).Methods("POST")
+	protected.HandleFunc("/rooms/by-name/{slug}", wsServer.GetRoomByName).Methods("GET")
+	protected.HandleFunc("/rooms/{roomId}", wsServer.GetRoom).Methods("GET")
+	protected.HandleFunc("/rooms/{roomId}", wsServer.UpdateRoom).Methods("PATCH")
+	protected.HandleFunc("/rooms/{roomId}/archive", wsServer.ArchiveRoom).Methods("POST")
+	protected.HandleFunc("/rooms/{roomId}/archive", wsServer.UnarchiveRoom).Methods("DELETE")
+	protected.HandleFunc("/rooms/{roomId}/retention", wsServer.SetRoomRetention).Methods("PUT")
+	protected.HandleFunc("/rooms/{roomId}/attachments", wsServer.UploadAttachment).Methods("POST")
+	protected.HandleFunc("/attachments/{id}", wsServer.DownloadAttachment).Methods("GET")
+	protected.HandleFunc("/dms", wsServer.CreateDirectConversation).Methods("POST")
+	protected.HandleFunc("/rooms/{roomId}/invitations", wsServer.InviteToRoom).Methods("POST")
+	protected.HandleFunc("/rooms/{roomId}/invitations/accept", wsServer.AcceptInvitation).Methods("POST")
+	protected.HandleFunc("/rooms/{roomId}/invitations/decline", wsServer.DeclineInvitation).Methods("POST")
+	protected.HandleFunc("/rooms/{roomId}/members/{userId}", wsServer.RemoveMember).Methods("DELETE")
+	protected.HandleFunc("/rooms/{roomId}/members/{userId}/role", wsServer.SetMemberRole).Methods("PUT")
+	protected.HandleFunc("/rooms/{roomId}/bans/{userId}", wsServer.BanMember).Methods("PUT")
+	protected.HandleFunc("/rooms/{roomId}/bans/{userId}", wsServer.UnbanMember).Methods("DELETE")
+	protected.HandleFunc("/invitations", wsServer.GetInvitations).Methods("GET")
+	protected.HandleFunc("/mentions", wsServer.GetMentions).Methods("GET")
+	protected.HandleFunc("/admin/import", wsServer.ImportHistory).Methods("POST")
+	protected.HandleFunc("/search/messages", wsServer.SearchMessages).Methods("GET")
 	protected.HandleFunc("/messages", wsServer.CreateMessage).Methods("POST")
+	protected.HandleFunc("/messages/{id}", wsServer.EditMessage).Methods("PATCH")
+	protected.HandleFunc("/messages/{id}", wsServer.DeleteMessage).Methods("DELETE")
+	protected.HandleFunc("/messages/{id}/thread", wsServer.GetThread).Methods("GET")
+	protected.HandleFunc("/messages/{id}/receipts", wsServer.GetReceipts).Methods("GET")
+	protected.HandleFunc("/messages/{id}/pin", wsServer.PinMessage).Methods("POST")
+	protected.HandleFunc("/messages/{id}/pin", wsServer.UnpinMessage).Methods("DELETE")
+	protected.HandleFunc("/messages/{id}/reactions", wsServer.AddReaction).Methods("POST")
+	protected.HandleFunc("/messages/{id}/reactions/{emoji}", wsServer.RemoveReaction).Methods("DELETE")
+	protected.HandleFunc("/ws", service.ServeWs(wsServer, defaultClientConfig, logger))
 	protected.HandleFunc("/ws/{roomId}", service.ServeWs(wsServer, defaultClientConfig, logger))
+	protected.HandleFunc("/ws/by-name/{slug}", service.ServeWs(wsServer, defaultClientConfig, logger))
 	protected.Use(wsServer.IsAuthenticated)
 	r.PathPrefix("/").Handler(http.FileServer(http.Dir(staticFiles)))
 
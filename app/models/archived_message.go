@@ -0,0 +1,19 @@
+package models
+
+import "time"
+
+// ArchivedMessage keeps a message that was removed from its room by the retention policy,
+// when the site archives expired messages instead of deleting them
+type ArchivedMessage struct {
+	ID         uint       `gorm:"primarykey" json:"id"`
+	RoomID     uint       `gorm:"not null;index" json:"roomId"`
+	UserID     uint       `gorm:"not null" json:"userId"`
+	ParentID   *uint      `json:"parentId"`
+	Seq        uint64     `gorm:"not null" json:"seq"`
+	Text       string     `gorm:"not null" json:"text"`
+	Type       string     `gorm:"not null" json:"type"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	EditedAt   *time.Time `json:"editedAt"`
+	DeletedAt  *time.Time `json:"deletedAt"`
+	ArchivedAt time.Time  `gorm:"not null" json:"archivedAt"`
+}
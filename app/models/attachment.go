@@ -0,0 +1,88 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// MaxAttachmentSize caps the size of an uploaded file, in bytes
+const MaxAttachmentSize = 10 << 20
+
+// maxFilenameLength caps how long an attachment's file name can be, in characters
+const maxFilenameLength = 255
+
+// attachmentTypes are the kinds of files users can share, as detected from their content
+var attachmentTypes = map[string]bool{
+	"image/png":          true,
+	"image/jpeg":         true,
+	"image/gif":          true,
+	"image/webp":         true,
+	"text/plain":         true,
+	"application/pdf":    true,
+	"application/zip":    true,
+	"application/x-gzip": true,
+}
+
+// Attachment is a file shared in a message. The file itself is kept by the storage
+// under StorageKey, the table only has what's needed to list and serve it
+type Attachment struct {
+	ID          uint      `gorm:"primarykey" json:"id"`
+	MessageID   uint      `gorm:"not null;index" json:"messageId"`
+	RoomID      uint      `gorm:"not null;index" json:"roomId"`
+	UserID      uint      `gorm:"not null" json:"userId"`
+	Filename    string    `gorm:"not null" json:"filename"`
+	ContentType string    `gorm:"not null" json:"contentType"`
+	Size        int64     `gorm:"not null" json:"size"`
+	StorageKey  string    `gorm:"not null;uniqueIndex" json:"-"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+// Init prepares an attachment object to be saved, keeping only the base of its file name
+func (a *Attachment) Init() {
+	a.Filename = strings.TrimSpace(filepath.Base(strings.ReplaceAll(a.Filename, `\`, "/")))
+	if a.Filename == "." || a.Filename == "/" {
+		a.Filename = ""
+	}
+
+	a.CreatedAt = time.Now()
+}
+
+// IsImage tells if the attachment can be shown inline as a picture
+func (a *Attachment) IsImage() bool {
+	return strings.HasPrefix(a.ContentType, "image/")
+}
+
+// Validate checks if an attachment model is correctly formed
+func (a *Attachment) Validate() error {
+	if a.Filename == "" {
+		return errors.New("file name is missing")
+	}
+
+	if utf8.RuneCountInString(a.Filename) > maxFilenameLength {
+		return fmt.Errorf("file name can't be longer than %d characters", maxFilenameLength)
+	}
+
+	if a.Size == 0 {
+		return errors.New("file is empty")
+	}
+
+	if a.Size > MaxAttachmentSize {
+		return fmt.Errorf("files can't be bigger than %d MB", MaxAttachmentSize>>20)
+	}
+
+	mediaType, _, err := mime.ParseMediaType(a.ContentType)
+	if err != nil || !attachmentTypes[mediaType] {
+		return errors.New("this type of file can't be shared")
+	}
+
+	if a.StorageKey == "" {
+		return errors.New("storage key is missing")
+	}
+
+	return nil
+}
@@ -0,0 +1,68 @@
+package models_test
+
+import (
+	"testing"
+
+	"github.com/msanatan/go-chatroom/app/models"
+)
+
+func Test_AttachmentValidate(t *testing.T) {
+	tests := []struct {
+		name       string
+		attachment models.Attachment
+		valid      bool
+	}{
+		{
+			name:       "testing a log file",
+			attachment: models.Attachment{Filename: "server.log", ContentType: "text/plain; charset=utf-8", Size: 2048, StorageKey: "rooms/1/a"},
+			valid:      true,
+		},
+		{
+			name:       "testing a screenshot",
+			attachment: models.Attachment{Filename: "screenshot.png", ContentType: "image/png", Size: 1 << 20, StorageKey: "rooms/1/b"},
+			valid:      true,
+		},
+		{
+			name:       "testing a file that's too big",
+			attachment: models.Attachment{Filename: "dump.zip", ContentType: "application/zip", Size: models.MaxAttachmentSize + 1, StorageKey: "rooms/1/c"},
+		},
+		{
+			name:       "testing an empty file",
+			attachment: models.Attachment{Filename: "empty.txt", ContentType: "text/plain", StorageKey: "rooms/1/d"},
+		},
+		{
+			name:       "testing a type that's not allowed",
+			attachment: models.Attachment{Filename: "page.html", ContentType: "text/html; charset=utf-8", Size: 512, StorageKey: "rooms/1/e"},
+		},
+		{
+			name:       "testing a missing file name",
+			attachment: models.Attachment{ContentType: "image/png", Size: 512, StorageKey: "rooms/1/f"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.attachment.Validate()
+			if (err == nil) != tt.valid {
+				t.Errorf("wrong validity. expected %v but received error %v", tt.valid, err)
+			}
+		})
+	}
+}
+
+func Test_AttachmentInitKeepsBaseName(t *testing.T) {
+	tests := map[string]string{
+		"screenshot.png":               "screenshot.png",
+		"../../etc/passwd":             "passwd",
+		`C:\Users\alice\Desktop\a.log`: "a.log",
+		"  notes.txt ":                 "notes.txt",
+	}
+
+	for filename, expected := range tests {
+		attachment := models.Attachment{Filename: filename}
+		attachment.Init()
+		if attachment.Filename != expected {
+			t.Errorf("wrong file name for %q. expected %q but received %q", filename, expected, attachment.Filename)
+		}
+	}
+}
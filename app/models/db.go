@@ -2,6 +2,7 @@ package models
 
 import (
 	"database/sql"
+	"fmt"
 
 	log "github.com/sirupsen/logrus"
 	"gorm.io/driver/postgres"
@@ -47,5 +48,154 @@ func (c *ChatroomDB) Migrate() error {
 		return err
 	}
 
+	err = c.DB.AutoMigrate(&MessageEdit{})
+	if err != nil {
+		return err
+	}
+
+	err = c.DB.AutoMigrate(&Reaction{})
+	if err != nil {
+		return err
+	}
+
+	err = c.DB.AutoMigrate(&RoomMembership{})
+	if err != nil {
+		return err
+	}
+
+	err = c.DB.AutoMigrate(&Mention{})
+	if err != nil {
+		return err
+	}
+
+	err = c.DB.AutoMigrate(&Pin{})
+	if err != nil {
+		return err
+	}
+
+	err = c.DB.AutoMigrate(&Attachment{})
+	if err != nil {
+		return err
+	}
+
+	err = c.DB.AutoMigrate(&ArchivedMessage{})
+	if err != nil {
+		return err
+	}
+
+	// Message history is paged by ID within a room
+	err = c.DB.Exec("CREATE INDEX IF NOT EXISTS idx_messages_room_id_id ON messages (room_id, id)").Error
+	if err != nil {
+		return err
+	}
+
+	// Messages are searched through a tsvector of their text. Postgres generates it,
+	// for existing messages too, so it never falls out of date
+	err = c.DB.Exec("ALTER TABLE messages ADD COLUMN IF NOT EXISTS search_vector tsvector GENERATED ALWAYS AS (to_tsvector('" +
+		SearchConfig + "', text)) STORED").Error
+	if err != nil {
+		return err
+	}
+
+	err = c.DB.Exec("CREATE INDEX IF NOT EXISTS idx_messages_search_vector ON messages USING GIN (search_vector)").Error
+	if err != nil {
+		return err
+	}
+
+	err = c.backfillSequences()
+	if err != nil {
+		return err
+	}
+
+	// Direct conversations made before rooms had a visibility were saved as public
+	err = c.DB.Model(&Room{}).Where("kind = ? AND visibility <> ?", RoomKindDirect, RoomPrivate).
+		Update("visibility", RoomPrivate).Error
+	if err != nil {
+		return err
+	}
+
+	err = c.backfillOwners()
+	if err != nil {
+		return err
+	}
+
+	err = c.backfillSlugs()
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
+
+// backfillOwners makes the first member of each room that has no owner its owner.
+// Rooms were created with their creator as the first member before they had roles
+func (c *ChatroomDB) backfillOwners() error {
+	return c.DB.Exec(`UPDATE room_memberships SET role = ? WHERE id IN (
+			SELECT MIN(room_memberships.id) FROM room_memberships JOIN rooms ON rooms.id = room_memberships.room_id
+			WHERE rooms.kind = ? AND room_memberships.status = ? GROUP BY room_memberships.room_id
+			HAVING COUNT(*) FILTER (WHERE room_memberships.role = ?) = 0)`,
+		RoleOwner, RoomKindChannel, MembershipActive, RoleOwner).Error
+}
+
+// backfillSlugs gives channels created before rooms had slugs one. Rooms that
+// share a name with an older one get their ID added to their slug
+func (c *ChatroomDB) backfillSlugs() error {
+	var rooms []Room
+	err := c.DB.Unscoped().Where("slug IS NULL AND kind = ?", RoomKindChannel).Order("id asc").Find(&rooms).Error
+	if err != nil {
+		return err
+	}
+
+	for _, room := range rooms {
+		slug := Slugify(room.Name)
+		if slug == "" {
+			slug = "room"
+		}
+
+		var count int64
+		err = c.DB.Unscoped().Model(&Room{}).Where("slug = ?", slug).Count(&count).Error
+		if err != nil {
+			return err
+		}
+
+		if count > 0 {
+			slug = fmt.Sprintf("%s-%d", slug, room.ID)
+		}
+
+		err = c.DB.Unscoped().Model(&room).Update("slug", slug).Error
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// backfillSequences numbers messages saved before they had sequence numbers, and
+// dates rooms' latest activity, then makes sure no two messages in a room can share one
+func (c *ChatroomDB) backfillSequences() error {
+	return c.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Exec(`UPDATE messages SET seq = numbered.seq
+			FROM (SELECT id, ROW_NUMBER() OVER (PARTITION BY room_id ORDER BY id) AS seq FROM messages) AS numbered
+			WHERE messages.id = numbered.id AND messages.room_id IN (SELECT DISTINCT room_id FROM messages WHERE seq = 0)`).Error
+		if err != nil {
+			return err
+		}
+
+		err = tx.Exec(`UPDATE rooms SET last_seq = latest.seq
+			FROM (SELECT room_id, MAX(seq) AS seq FROM messages GROUP BY room_id) AS latest
+			WHERE rooms.id = latest.room_id AND rooms.last_seq < latest.seq`).Error
+		if err != nil {
+			return err
+		}
+
+		err = tx.Exec(`UPDATE rooms SET last_message_at = latest.created_at
+			FROM (SELECT room_id, MAX(created_at) AS created_at FROM messages GROUP BY room_id) AS latest
+			WHERE rooms.id = latest.room_id AND rooms.last_message_at IS NULL`).Error
+		if err != nil {
+			return err
+		}
+
+		return tx.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_messages_room_id_seq ON messages (room_id, seq)").Error
+	})
+}
@@ -0,0 +1,59 @@
+package models
+
+import (
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Kinds of mentions
+const (
+	// MentionUser is a user mentioned by their username
+	MentionUser = "user"
+	// MentionRoom is everyone in the room, mentioned with @room
+	MentionRoom = "room"
+	// MentionHere is everyone connected to the room, mentioned with @here
+	MentionHere = "here"
+)
+
+// mentionPattern finds @mentions that start a word, so email addresses aren't mistaken for them
+var mentionPattern = regexp.MustCompile(`(?:^|[^\p{L}\p{N}_])@([\p{L}\p{N}_.\-]+)`)
+
+// Mention records that a message mentioned a user, directly or through @room or @here
+type Mention struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	MessageID uint      `gorm:"not null;uniqueIndex:idx_mentions_message_user" json:"messageId"`
+	Message   *Message  `json:"-"`
+	UserID    uint      `gorm:"not null;uniqueIndex:idx_mentions_message_user;index" json:"userId"`
+	User      *User     `json:"-"`
+	Kind      string    `gorm:"not null" json:"kind"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Init prepares a mention object to be saved
+func (m *Mention) Init() {
+	m.CreatedAt = time.Now()
+}
+
+// ParseMentions finds who a message mentions: the lowercased usernames it names, and
+// whether it mentions the whole room or everyone connected to it
+func ParseMentions(text string) (usernames []string, room bool, here bool) {
+	seen := make(map[string]bool)
+	for _, match := range mentionPattern.FindAllStringSubmatch(text, -1) {
+		// Punctuation ending a sentence isn't part of the username
+		name := strings.ToLower(strings.TrimRight(match[1], ".-"))
+		switch {
+		case name == "":
+			continue
+		case name == MentionRoom:
+			room = true
+		case name == MentionHere:
+			here = true
+		case !seen[name]:
+			seen[name] = true
+			usernames = append(usernames, name)
+		}
+	}
+
+	return usernames, room, here
+}
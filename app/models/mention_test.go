@@ -0,0 +1,56 @@
+package models_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/msanatan/go-chatroom/app/models"
+)
+
+func Test_ParseMentions(t *testing.T) {
+	tests := []struct {
+		name      string
+		text      string
+		usernames []string
+		room      bool
+		here      bool
+	}{
+		{
+			name:      "testing usernames",
+			text:      "@Alice can you ask @bob.smith?",
+			usernames: []string{"alice", "bob.smith"},
+		},
+		{
+			name:      "testing repeated and trailing punctuation",
+			text:      "thanks @alice. See you, @alice-",
+			usernames: []string{"alice"},
+		},
+		{
+			name: "testing room and here",
+			text: "@room the build is broken, @here who's around?",
+			room: true,
+			here: true,
+		},
+		{
+			name: "testing email addresses",
+			text: "write to support@example.com",
+		},
+		{
+			name: "testing a lone at sign",
+			text: "meet @ 5",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			usernames, room, here := models.ParseMentions(tt.text)
+			if !reflect.DeepEqual(usernames, tt.usernames) {
+				t.Errorf("wrong usernames. expected %v but received %v", tt.usernames, usernames)
+			}
+
+			if room != tt.room || here != tt.here {
+				t.Errorf("wrong room and here. expected %t and %t but received %t and %t", tt.room, tt.here, room, here)
+			}
+		})
+	}
+}
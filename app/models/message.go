@@ -4,18 +4,32 @@ import (
 	"errors"
 	"time"
 
-	"github.com/jinzhu/gorm"
+	"gorm.io/gorm"
 )
 
+// SearchConfig is the Postgres text search configuration messages are indexed with
+const SearchConfig = "english"
+
 // Message saves a message sent from the client
+// Seq numbers the messages within a room, going up by one with every message.
+// Messages also have a search_vector column for full text search, which Postgres
+// keeps up to date from Text, see ChatroomDB.Migrate
 type Message struct {
 	gorm.Model
 	Text   string `gorm:"not null;" json:"text"`
 	Type   string `gorm:"not null;" json:"type"`
+	Seq    uint64 `gorm:"not null;default:0" json:"seq"`
 	UserID uint
 	User   *User
 	RoomID uint
 	Room   *Room
+	// ParentID is set on replies, pointing to the message that started the thread
+	ParentID *uint `gorm:"index" json:"parentId"`
+	// EditedAt is set when the message's text was changed after it was sent
+	EditedAt *time.Time
+	// ImportKey identifies messages imported from another tool, so they're only imported once
+	ImportKey   *string `gorm:"uniqueIndex" json:"-"`
+	Attachments []Attachment
 }
 
 // Init prepares a message object to be saved
@@ -44,3 +58,22 @@ func (m *Message) Validate() error {
 
 	return nil
 }
+
+// Edit changes the message's text, returning the edit history entry to save with it
+func (m *Message) Edit(text string, userID uint) (*MessageEdit, error) {
+	if text == "" {
+		return nil, errors.New("message text is missing")
+	}
+
+	edit := &MessageEdit{
+		MessageID:    m.ID,
+		UserID:       userID,
+		PreviousText: m.Text,
+	}
+	edit.Init()
+
+	editedAt := time.Now()
+	m.Text = text
+	m.EditedAt = &editedAt
+	return edit, nil
+}
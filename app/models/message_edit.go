@@ -0,0 +1,21 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// MessageEdit keeps what a message said before it was edited
+type MessageEdit struct {
+	gorm.Model
+	MessageID    uint   `gorm:"not null;index" json:"messageId"`
+	UserID       uint   `gorm:"not null" json:"userId"`
+	PreviousText string `gorm:"not null" json:"previousText"`
+}
+
+// Init prepares a message edit object to be saved
+func (m *MessageEdit) Init() {
+	m.CreatedAt = time.Now()
+	m.UpdatedAt = time.Now()
+}
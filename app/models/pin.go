@@ -0,0 +1,21 @@
+package models
+
+import "time"
+
+// MaxPinsPerRoom caps how many messages can be pinned in a room
+const MaxPinsPerRoom = 50
+
+// Pin marks a message as pinned in its room. A message can only be pinned once
+type Pin struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	RoomID    uint      `gorm:"not null;index" json:"roomId"`
+	MessageID uint      `gorm:"not null;uniqueIndex" json:"messageId"`
+	Message   *Message  `json:"-"`
+	PinnedBy  uint      `gorm:"not null" json:"pinnedBy"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Init prepares a pin object to be saved
+func (p *Pin) Init() {
+	p.CreatedAt = time.Now()
+}
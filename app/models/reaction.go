@@ -0,0 +1,49 @@
+package models
+
+import (
+	"errors"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// maxEmojiLength caps the size of a reaction, in characters. It leaves room
+// for emoji built out of several code points, like flags and skin tones
+const maxEmojiLength = 16
+
+// Reaction is an emoji a user put on a message. A user can react to a
+// message with many emoji, but with each one only once
+type Reaction struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	MessageID uint      `gorm:"not null;uniqueIndex:idx_reactions_message_user_emoji" json:"messageId"`
+	UserID    uint      `gorm:"not null;uniqueIndex:idx_reactions_message_user_emoji" json:"userId"`
+	Emoji     string    `gorm:"not null;uniqueIndex:idx_reactions_message_user_emoji" json:"emoji"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Init prepares a reaction object to be saved
+func (r *Reaction) Init() {
+	r.Emoji = strings.TrimSpace(r.Emoji)
+	r.CreatedAt = time.Now()
+}
+
+// Validate checks if a reaction model is correctly formed
+func (r *Reaction) Validate() error {
+	if r.Emoji == "" {
+		return errors.New("emoji is missing")
+	}
+
+	if utf8.RuneCountInString(r.Emoji) > maxEmojiLength || strings.ContainsAny(r.Emoji, " \t\n") {
+		return errors.New("a reaction can only be a single emoji")
+	}
+
+	if r.MessageID == 0 {
+		return errors.New("message ID is missing")
+	}
+
+	if r.UserID == 0 {
+		return errors.New("user ID is missing")
+	}
+
+	return nil
+}
@@ -2,29 +2,175 @@ package models
 
 import (
 	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"gorm.io/gorm"
 )
 
+// Kinds of rooms
+const (
+	// RoomKindChannel rooms are open to everyone
+	RoomKindChannel = "channel"
+	// RoomKindDirect rooms are private conversations between a fixed set of users
+	RoomKindDirect = "direct"
+)
+
+// Room visibilities
+const (
+	// RoomPublic rooms can be read and joined by anyone
+	RoomPublic = "public"
+	// RoomPrivate rooms are only open to the users invited to them
+	RoomPrivate = "private"
+)
+
+// Limits on a room's details
+const (
+	maxTopicLength       = 250
+	maxDescriptionLength = 2000
+)
+
 // Room represents one dedicated channel to chat in
 type Room struct {
 	gorm.Model
-	Name     string `gorm:"not null;" json:"name"`
-	Messages []Message
+	Name        string `gorm:"not null;" json:"name"`
+	Kind        string `gorm:"not null;default:channel" json:"kind"`
+	Visibility  string `gorm:"not null;default:public" json:"visibility"`
+	Topic       string `gorm:"not null;default:''" json:"topic"`
+	Description string `gorm:"not null;default:''" json:"description"`
+	// ArchivedAt is set on rooms that were made read-only
+	ArchivedAt *time.Time `json:"archivedAt"`
+	// Slug is the channel's name as used in URLs. It's unique, so no two channels
+	// can have names that only differ in case or punctuation
+	Slug *string `gorm:"uniqueIndex" json:"slug"`
+	// DirectKey identifies the members of a direct conversation, so there's only one per set of users
+	DirectKey *string `gorm:"uniqueIndex" json:"-"`
+	// LastSeq is the sequence number of the room's latest message
+	LastSeq uint64 `gorm:"not null;default:0" json:"lastSeq"`
+	// LastMessageAt is when the room's latest message was sent, to sort rooms by activity
+	LastMessageAt *time.Time `gorm:"index" json:"lastMessageAt"`
+	// RetentionDays and RetentionMessages override the site's retention policy for the room.
+	// Nil follows the site's policy, and 0 keeps messages forever
+	RetentionDays     *int `json:"retentionDays"`
+	RetentionMessages *int `json:"retentionMessages"`
+	Messages          []Message
 }
 
 // Init prepares a room object to be saved
 func (r *Room) Init() {
+	if r.Kind == "" {
+		r.Kind = RoomKindChannel
+	}
+
+	if r.IsDirect() {
+		r.Visibility = RoomPrivate
+	} else if r.Visibility == "" {
+		r.Visibility = RoomPublic
+	}
+
+	r.Rename(r.Name)
 	r.CreatedAt = time.Now()
 	r.UpdatedAt = time.Now()
 }
 
+// Rename changes the room's name, and its slug with it. Direct conversations don't have slugs
+func (r *Room) Rename(name string) {
+	r.Name = name
+	if r.IsDirect() {
+		r.Slug = nil
+		return
+	}
+
+	slug := Slugify(name)
+	r.Slug = &slug
+}
+
+// Slugify turns a room name into its slug: lowercase letters and numbers, with dashes between words
+func Slugify(name string) string {
+	var slug strings.Builder
+	dash := false
+	for _, char := range strings.ToLower(name) {
+		if unicode.IsLetter(char) || unicode.IsDigit(char) {
+			slug.WriteRune(char)
+			dash = false
+		} else if slug.Len() > 0 && !dash {
+			slug.WriteRune('-')
+			dash = true
+		}
+	}
+
+	return strings.TrimSuffix(slug.String(), "-")
+}
+
+// IsDirect tells if the room is a direct conversation
+func (r *Room) IsDirect() bool {
+	return r.Kind == RoomKindDirect
+}
+
+// IsArchived tells if the room was made read-only
+func (r *Room) IsArchived() bool {
+	return r.ArchivedAt != nil
+}
+
+// IsPrivate tells if only the room's members can use it. Direct conversations always are
+func (r *Room) IsPrivate() bool {
+	return r.Visibility == RoomPrivate || r.IsDirect()
+}
+
+// DirectKeyFor builds the key that identifies the direct conversation between some users
+func DirectKeyFor(userIDs []uint) string {
+	sorted := make([]uint, len(userIDs))
+	copy(sorted, userIDs)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+
+	ids := make([]string, len(sorted))
+	for i, id := range sorted {
+		ids[i] = strconv.FormatUint(uint64(id), 10)
+	}
+
+	return strings.Join(ids, ",")
+}
+
 // Validate checks if a message model is correctly formed
 func (r *Room) Validate() error {
 	if r.Name == "" {
 		return errors.New("room name is missing")
 	}
 
+	if r.Kind != RoomKindChannel && r.Kind != RoomKindDirect {
+		return errors.New("room kind is not valid")
+	}
+
+	if !r.IsDirect() && (r.Slug == nil || *r.Slug == "") {
+		return errors.New("room name needs some letters or numbers")
+	}
+
+	if r.Visibility != RoomPublic && r.Visibility != RoomPrivate {
+		return errors.New("room visibility must be public or private")
+	}
+
+	if utf8.RuneCountInString(r.Topic) > maxTopicLength {
+		return fmt.Errorf("room topic can't be longer than %d characters", maxTopicLength)
+	}
+
+	if utf8.RuneCountInString(r.Description) > maxDescriptionLength {
+		return fmt.Errorf("room description can't be longer than %d characters", maxDescriptionLength)
+	}
+
+	if (r.RetentionDays != nil && *r.RetentionDays < 0) || (r.RetentionMessages != nil && *r.RetentionMessages < 0) {
+		return errors.New("room retention can't be negative")
+	}
+
+	if r.IsDirect() && r.DirectKey == nil {
+		return errors.New("direct conversations need their members")
+	}
+
 	return nil
 }
@@ -0,0 +1,95 @@
+package models
+
+import (
+	"errors"
+	"time"
+)
+
+// Membership statuses
+const (
+	// MembershipActive members can use the room
+	MembershipActive = "active"
+	// MembershipInvited users were asked to join the room but haven't accepted yet
+	MembershipInvited = "invited"
+	// MembershipBanned users can't see or join the room, even if it's public
+	MembershipBanned = "banned"
+)
+
+// Roles members can have in a room, from most to least powerful
+const (
+	// RoleOwner is the room's creator, who can do anything in it
+	RoleOwner = "owner"
+	// RoleModerator members can rename the room, delete messages and remove or ban members
+	RoleModerator = "moderator"
+	// RoleMember is everyone else
+	RoleMember = "member"
+)
+
+var roleRanks = map[string]int{
+	RoleMember:    1,
+	RoleModerator: 2,
+	RoleOwner:     3,
+}
+
+// RoomMembership records that a user belongs to a room, or was invited to it
+type RoomMembership struct {
+	ID        uint   `gorm:"primarykey" json:"id"`
+	RoomID    uint   `gorm:"not null;uniqueIndex:idx_room_memberships_room_user" json:"roomId"`
+	Room      *Room  `json:"-"`
+	UserID    uint   `gorm:"not null;uniqueIndex:idx_room_memberships_room_user;index" json:"userId"`
+	User      *User  `json:"-"`
+	Status    string `gorm:"not null;default:active" json:"status"`
+	Role      string `gorm:"not null;default:member" json:"role"`
+	InvitedBy *uint  `json:"invitedBy,omitempty"`
+	// LastReadSeq is the sequence number of the last message the member read in the room
+	LastReadSeq uint64    `gorm:"not null;default:0" json:"lastReadSeq"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+// Init prepares a room membership object to be saved
+func (m *RoomMembership) Init() {
+	if m.Status == "" {
+		m.Status = MembershipActive
+	}
+
+	if m.Role == "" {
+		m.Role = RoleMember
+	}
+
+	m.CreatedAt = time.Now()
+}
+
+// IsActive tells if the user has joined the room
+func (m *RoomMembership) IsActive() bool {
+	return m.Status == MembershipActive
+}
+
+// IsBanned tells if the user was banned from the room
+func (m *RoomMembership) IsBanned() bool {
+	return m.Status == MembershipBanned
+}
+
+// CanModerate tells if the member can manage the room's messages and members
+func (m *RoomMembership) CanModerate() bool {
+	return m.IsActive() && roleRanks[m.Role] >= roleRanks[RoleModerator]
+}
+
+// IsOwner tells if the member owns the room
+func (m *RoomMembership) IsOwner() bool {
+	return m.IsActive() && m.Role == RoleOwner
+}
+
+// Outranks tells if the member's role is above another's. Members can only
+// moderate those below them
+func (m *RoomMembership) Outranks(other RoomMembership) bool {
+	return roleRanks[m.Role] > roleRanks[other.Role]
+}
+
+// ValidRole checks a role can be given to a member. There's only one owner per room
+func ValidRole(role string) error {
+	if role != RoleModerator && role != RoleMember {
+		return errors.New("role must be moderator or member")
+	}
+
+	return nil
+}
@@ -0,0 +1,73 @@
+package models_test
+
+import (
+	"testing"
+
+	"github.com/msanatan/go-chatroom/app/models"
+)
+
+func Test_Slugify(t *testing.T) {
+	tests := []struct {
+		name     string
+		roomName string
+		expected string
+	}{
+		{
+			name:     "testing lowercase",
+			roomName: "General",
+			expected: "general",
+		},
+		{
+			name:     "testing spaces and punctuation",
+			roomName: "  Release -- Planning! ",
+			expected: "release-planning",
+		},
+		{
+			name:     "testing numbers",
+			roomName: "Go 1.16",
+			expected: "go-1-16",
+		},
+		{
+			name:     "testing accents",
+			roomName: "Café Olé",
+			expected: "café-olé",
+		},
+		{
+			name:     "testing only punctuation",
+			roomName: "!!!",
+			expected: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			slug := models.Slugify(tt.roomName)
+			if slug != tt.expected {
+				t.Errorf("wrong slug. expected %q but received %q", tt.expected, slug)
+			}
+		})
+	}
+}
+
+func Test_DirectConversationsHaveNoSlug(t *testing.T) {
+	directKey := models.DirectKeyFor([]uint{2, 1})
+	room := models.Room{
+		Name:      "alice, bob",
+		Kind:      models.RoomKindDirect,
+		DirectKey: &directKey,
+	}
+	room.Init()
+
+	if room.Slug != nil {
+		t.Errorf("expected no slug but received %q", *room.Slug)
+	}
+
+	if directKey != "1,2" {
+		t.Errorf("wrong direct key. expected %q but received %q", "1,2", directKey)
+	}
+
+	err := room.Validate()
+	if err != nil {
+		t.Errorf("did not expect an error but received : %q", err.Error())
+	}
+}
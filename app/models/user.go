@@ -17,6 +17,8 @@ type User struct {
 	Username string `gorm:"not null;unique" json:"username"`
 	Email    string `gorm:"not null;unique" json:"email"`
 	Password string `gorm:"not null;" json:"password"`
+	// IsAdmin users run the site. It can't be set through the API
+	IsAdmin  bool `gorm:"not null;default:false" json:"-"`
 	Messages []Message
 }
 
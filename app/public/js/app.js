@@ -63,26 +63,20 @@ var app = new Vue({
                 console.error(this.authError);
             }
         },
-        async sendMessage() {
-            if (this.newMessage !== "") {
-                try {
-                    const response = await axios.post(`http://${location.host}/api/messages`,
-                        {
-                            message: this.newMessage,
-                            type: "user",
-                            username: this.user.username,
-                            roomId: this.room.id,
-                        }, {
-                        headers: {
-                            'Content-Type': 'application/json',
-                            'Authorization': 'Bearer ' + this.user.token
-                        }
-                    });
+        sendMessage() {
+            if (this.newMessage !== "" && this.ws && this.ws.readyState === WebSocket.OPEN) {
+                this.ws.send(JSON.stringify({
+                    v: 1,
+                    kind: "message",
+                    requestId: `${Date.now()}`,
+                    roomId: this.room.id,
+                    payload: {
+                        message: this.newMessage,
+                        type: "user",
+                    },
+                }));
 
-                    this.newMessage = "";
-                } catch (e) {
-                    console.error(e);
-                }
+                this.newMessage = "";
             }
         },
         async getLatestMessages() {
@@ -154,9 +148,21 @@ var app = new Vue({
             console.log("Connected to chat room");
         },
         handleNewMessage(event) {
-            let msg = JSON.parse(event.data);
+            let envelope = JSON.parse(event.data);
+            if (envelope.kind === "error") {
+                console.error(envelope.payload.message);
+                return;
+            }
+
+            // Only chat messages are shown in the room
+            if (envelope.kind !== "message") {
+                return;
+            }
+
+            let msg = envelope.payload;
+            // Keep the chat to the size of a page of history, dropping the oldest
             if (this.messages.length === 50) {
-                this.messages.pop();
+                this.messages.shift();
             }
             this.messages.push(msg);
         },
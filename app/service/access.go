@@ -0,0 +1,220 @@
+package service
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/msanatan/go-chatroom/app/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// findAccessibleRoom loads a room, making sure the user is allowed to read and post in it.
+// Public channels are open to everyone who isn't banned, private rooms only to their active members
+func (s *Server) findAccessibleRoom(userID, roomID uint) (models.Room, error) {
+	room, _, err := s.findRoomMembership(userID, roomID)
+	return room, err
+}
+
+// findRoomMembership loads a room along with the user's membership of it, making sure
+// they can use the room. Users in public rooms they never joined get a plain member's membership
+func (s *Server) findRoomMembership(userID, roomID uint) (models.Room, models.RoomMembership, error) {
+	logger := s.logger.WithField("method", "findRoomMembership")
+
+	var room models.Room
+	var membership models.RoomMembership
+	tx := s.chatroomDB.DB.First(&room, roomID)
+	if tx.Error != nil {
+		logger.Errorf("could not find room %d: %s", roomID, tx.Error.Error())
+		return room, membership, newStatusError(http.StatusNotFound, "no room found with that ID")
+	}
+
+	tx = s.chatroomDB.DB.Where("room_id = ? AND user_id = ?", room.ID, userID).Limit(1).Find(&membership)
+	if tx.Error != nil {
+		logger.Errorf("could not check membership: %s", tx.Error.Error())
+		return room, membership, newStatusError(http.StatusForbidden, "you don't have access to this room")
+	}
+
+	if tx.RowsAffected == 0 && !room.IsPrivate() {
+		membership = models.RoomMembership{
+			RoomID: room.ID,
+			UserID: userID,
+		}
+		membership.Init()
+	}
+
+	if !membership.IsActive() {
+		logger.Errorf("user %d is not a member of room %d", userID, room.ID)
+		return room, membership, newStatusError(http.StatusForbidden, "you don't have access to this room")
+	}
+
+	return room, membership, nil
+}
+
+// findWritableRoom loads a room, making sure the user can post in it. Archived rooms are read-only
+func (s *Server) findWritableRoom(userID, roomID uint) (models.Room, error) {
+	room, err := s.findAccessibleRoom(userID, roomID)
+	if err != nil {
+		return room, err
+	}
+
+	if room.IsArchived() {
+		return room, newStatusError(http.StatusForbidden, "this room is archived")
+	}
+
+	return room, nil
+}
+
+// findRoomBySlug loads the channel with the given slug
+func (s *Server) findRoomBySlug(slug string) (models.Room, error) {
+	var room models.Room
+	tx := s.chatroomDB.DB.Where("slug = ?", strings.ToLower(slug)).First(&room)
+	if tx.Error != nil {
+		return room, newStatusError(http.StatusNotFound, "no room found with that name")
+	}
+
+	return room, nil
+}
+
+// slugTaken tells if another room already has a slug
+func (s *Server) slugTaken(slug *string, roomID uint) (bool, error) {
+	if slug == nil {
+		return false, nil
+	}
+
+	var count int64
+	tx := s.chatroomDB.DB.Unscoped().Model(&models.Room{}).Where("slug = ? AND id <> ?", *slug, roomID).Count(&count)
+	return count > 0, tx.Error
+}
+
+// canSubscribe checks a user may follow a room's live events. A server without
+// a database has no private rooms, so every room is open
+func (s *Server) canSubscribe(userID, roomID uint) error {
+	if s.chatroomDB == nil {
+		return nil
+	}
+
+	_, err := s.findAccessibleRoom(userID, roomID)
+	return err
+}
+
+// joinRoom checks a user may follow a room's live events, making them a member of public
+// rooms they open for the first time. Like canSubscribe, every room is open without a database
+func (s *Server) joinRoom(userID, roomID uint) error {
+	logger := s.logger.WithField("method", "joinRoom")
+	if s.chatroomDB == nil {
+		return nil
+	}
+
+	_, membership, err := s.findRoomMembership(userID, roomID)
+	if err != nil {
+		return err
+	}
+
+	err = s.addMember(membership)
+	if err != nil {
+		// Following the room doesn't depend on it
+		logger.Errorf("could not add user %d to room %d: %s", userID, roomID, err.Error())
+	}
+
+	return nil
+}
+
+// addMember saves the membership findRoomMembership made up for a user who never joined a public room
+func (s *Server) addMember(membership models.RoomMembership) error {
+	if membership.ID != 0 {
+		return nil
+	}
+
+	return s.chatroomDB.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&membership).Error
+}
+
+// visibleRooms narrows a room query down to the rooms a user can see
+func visibleRooms(tx *gorm.DB, userID uint) *gorm.DB {
+	memberships := func(status string) *gorm.DB {
+		return tx.Session(&gorm.Session{NewDB: true}).Model(&models.RoomMembership{}).Select("room_id").
+			Where("user_id = ? AND status = ?", userID, status)
+	}
+
+	return tx.Where("(rooms.visibility = ? AND rooms.id NOT IN (?)) OR rooms.id IN (?)", models.RoomPublic,
+		memberships(models.MembershipBanned), memberships(models.MembershipActive))
+}
+
+// newRoomPayload converts a stored room to its API form
+func newRoomPayload(room models.Room) RoomPayload {
+	return RoomPayload{
+		ID:                room.ID,
+		Name:              room.Name,
+		Kind:              room.Kind,
+		Visibility:        room.Visibility,
+		Slug:              room.Slug,
+		Topic:             room.Topic,
+		Description:       room.Description,
+		Archived:          room.IsArchived(),
+		RetentionDays:     room.RetentionDays,
+		RetentionMessages: room.RetentionMessages,
+	}
+}
+
+// attachMembers lists who's in each of the direct conversations among the given rooms
+func (s *Server) attachMembers(rooms []RoomPayload) error {
+	var roomIDs []uint
+	byID := make(map[uint]*RoomPayload)
+	for i := range rooms {
+		if rooms[i].Kind == models.RoomKindDirect {
+			roomIDs = append(roomIDs, rooms[i].ID)
+			byID[rooms[i].ID] = &rooms[i]
+		}
+	}
+
+	if len(roomIDs) == 0 {
+		return nil
+	}
+
+	var members []struct {
+		RoomID   uint
+		Username string
+	}
+	tx := s.chatroomDB.DB.Model(&models.RoomMembership{}).Select("room_memberships.room_id, users.username").
+		Joins("JOIN users ON users.id = room_memberships.user_id").
+		Where("room_memberships.room_id IN ? AND room_memberships.status = ?", roomIDs, models.MembershipActive).Order("users.username asc").Scan(&members)
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	for _, member := range members {
+		room := byID[member.RoomID]
+		room.Members = append(room.Members, member.Username)
+	}
+
+	return nil
+}
+
+// attachRoles adds the user's role to each of the rooms they can see
+func (s *Server) attachRoles(rooms []RoomPayload, userID uint) error {
+	if len(rooms) == 0 {
+		return nil
+	}
+
+	var roomIDs []uint
+	byID := make(map[uint]*RoomPayload)
+	for i := range rooms {
+		roomIDs = append(roomIDs, rooms[i].ID)
+		byID[rooms[i].ID] = &rooms[i]
+		// Users are plain members of the public rooms they never joined
+		rooms[i].Role = models.RoleMember
+	}
+
+	var memberships []models.RoomMembership
+	tx := s.chatroomDB.DB.Where("room_id IN ? AND user_id = ? AND status = ?", roomIDs, userID, models.MembershipActive).
+		Find(&memberships)
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	for _, membership := range memberships {
+		byID[membership.RoomID].Role = membership.Role
+	}
+
+	return nil
+}
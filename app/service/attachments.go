@@ -0,0 +1,240 @@
+package service
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/msanatan/go-chatroom/app/models"
+	"github.com/msanatan/go-chatroom/app/storage"
+	"github.com/msanatan/go-chatroom/utils"
+)
+
+// maxUploadMemory is how much of an upload is held in memory, the rest goes to a temporary file
+const maxUploadMemory = 1 << 20
+
+// newAttachmentPayload converts a stored attachment to its API form
+func newAttachmentPayload(attachment models.Attachment) AttachmentPayload {
+	return AttachmentPayload{
+		ID:          attachment.ID,
+		Filename:    attachment.Filename,
+		ContentType: attachment.ContentType,
+		Size:        attachment.Size,
+		URL:         fmt.Sprintf("/api/attachments/%d", attachment.ID),
+	}
+}
+
+// newStorageKey picks where a file uploaded to a room is stored. Keys are random so
+// they can't be guessed, and never reuse the name the file was uploaded with
+func newStorageKey(roomID uint) (string, error) {
+	random := make([]byte, 16)
+	_, err := rand.Read(random)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("rooms/%d/%s", roomID, hex.EncodeToString(random)), nil
+}
+
+// UploadAttachment is a handler that shares a file in a room. It takes a multipart form
+// with the file, and optionally the message to send with it and the thread it replies to
+func (s *Server) UploadAttachment(w http.ResponseWriter, r *http.Request) {
+	logger := s.logger.WithField("method", "UploadAttachment")
+
+	if s.storage == nil {
+		utils.WriteErrorResponse(w, http.StatusServiceUnavailable, errors.New("this chatroom isn't configured to store files"))
+		return
+	}
+
+	vars := mux.Vars(r)
+	roomID, err := strconv.ParseUint(vars["roomId"], 10, 32)
+	if err != nil {
+		logger.Errorf("room ID is not valid: %s", err.Error())
+		utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("you can only share files in a valid room ID"))
+		return
+	}
+
+	userID, username := userFromContext(r.Context())
+	_, err = s.findWritableRoom(userID, uint(roomID))
+	if err != nil {
+		writeStatusError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	// Leave some room for the rest of the form
+	r.Body = http.MaxBytesReader(w, r.Body, models.MaxAttachmentSize+maxUploadMemory)
+	err = r.ParseMultipartForm(maxUploadMemory)
+	if err != nil {
+		logger.Errorf("could not parse upload: %s", err.Error())
+		utils.WriteErrorResponse(w, http.StatusBadRequest,
+			fmt.Errorf("uploads must be multipart forms with a file of up to %d MB", models.MaxAttachmentSize>>20))
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("the file to share is missing"))
+		return
+	}
+	defer file.Close()
+
+	// The type the client claims isn't trusted, it's worked out from the file's first bytes
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		logger.Errorf("could not read upload: %s", err.Error())
+		utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("could not read the file"))
+		return
+	}
+
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		logger.Errorf("could not rewind upload: %s", err.Error())
+		utils.WriteErrorResponse(w, http.StatusInternalServerError, errors.New("could not read the file"))
+		return
+	}
+
+	storageKey, err := newStorageKey(uint(roomID))
+	if err != nil {
+		logger.Errorf("could not pick a storage key: %s", err.Error())
+		utils.WriteErrorResponse(w, http.StatusInternalServerError, errors.New("could not save the file"))
+		return
+	}
+
+	attachment := models.Attachment{
+		RoomID:      uint(roomID),
+		UserID:      userID,
+		Filename:    header.Filename,
+		ContentType: http.DetectContentType(head[:n]),
+		Size:        header.Size,
+		StorageKey:  storageKey,
+	}
+	attachment.Init()
+
+	err = attachment.Validate()
+	if err != nil {
+		logger.Errorf("attachment is not valid: %s", err.Error())
+		utils.WriteErrorResponse(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var parentID uint64
+	if parent := r.FormValue("parentId"); parent != "" {
+		parentID, err = strconv.ParseUint(parent, 10, 32)
+		if err != nil {
+			utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("parentId must be a message ID"))
+			return
+		}
+	}
+
+	err = s.storage.Put(r.Context(), attachment.StorageKey, file, attachment.Size, attachment.ContentType)
+	if err != nil {
+		logger.Errorf("could not store upload: %s", err.Error())
+		utils.WriteErrorResponse(w, http.StatusInternalServerError,
+			errors.New("could not save the file at this time, please try again"))
+		return
+	}
+
+	// Files can be shared without saying anything, their name is the message then
+	text := r.FormValue("message")
+	if text == "" {
+		text = attachment.Filename
+	}
+
+	responsePayload, err := s.persistMessage(userID, username, MessagePayload{
+		Message:  text,
+		Type:     "user",
+		RoomID:   uint(roomID),
+		ParentID: uint(parentID),
+	}, []models.Attachment{attachment})
+	if err != nil {
+		deleteErr := s.storage.Delete(r.Context(), attachment.StorageKey)
+		if deleteErr != nil {
+			logger.Errorf("could not remove unused upload %s: %s", attachment.StorageKey, deleteErr.Error())
+		}
+
+		writeStatusError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	resp, _ := json.Marshal(&responsePayload)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(resp)
+}
+
+// DownloadAttachment is a handler that serves a shared file to the people who can read its room.
+// Pictures are shown in the browser, everything else is downloaded
+func (s *Server) DownloadAttachment(w http.ResponseWriter, r *http.Request) {
+	logger := s.logger.WithField("method", "DownloadAttachment")
+
+	if s.storage == nil {
+		utils.WriteErrorResponse(w, http.StatusServiceUnavailable, errors.New("this chatroom isn't configured to store files"))
+		return
+	}
+
+	vars := mux.Vars(r)
+	attachmentID, err := strconv.ParseUint(vars["id"], 10, 32)
+	if err != nil {
+		logger.Errorf("attachment ID is not valid: %s", err.Error())
+		utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("attachment ID is not valid"))
+		return
+	}
+
+	// Files shared in deleted messages are gone along with them, while the ones in messages
+	// the retention policy archived are still served
+	var attachment models.Attachment
+	tx := s.chatroomDB.DB.Where(`EXISTS (SELECT 1 FROM messages WHERE messages.id = attachments.message_id AND messages.deleted_at IS NULL)
+		OR EXISTS (SELECT 1 FROM archived_messages WHERE archived_messages.id = attachments.message_id AND archived_messages.deleted_at IS NULL)`).
+		First(&attachment, attachmentID)
+	if tx.Error != nil {
+		logger.Errorf("could not find attachment: %s", tx.Error.Error())
+		utils.WriteErrorResponse(w, http.StatusNotFound, errors.New("no file found with that ID"))
+		return
+	}
+
+	userID, _ := userFromContext(r.Context())
+	_, err = s.findAccessibleRoom(userID, attachment.RoomID)
+	if err != nil {
+		writeStatusError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	file, err := s.storage.Get(r.Context(), attachment.StorageKey)
+	if err == storage.ErrNotFound {
+		utils.WriteErrorResponse(w, http.StatusNotFound, errors.New("no file found with that ID"))
+		return
+	}
+	if err != nil {
+		logger.Errorf("could not open attachment %d: %s", attachment.ID, err.Error())
+		utils.WriteErrorResponse(w, http.StatusInternalServerError,
+			errors.New("could not get the file at this time, please try again"))
+		return
+	}
+	defer file.Close()
+
+	disposition := "attachment"
+	if attachment.IsImage() {
+		disposition = "inline"
+	}
+
+	w.Header().Set("Content-Type", attachment.ContentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(attachment.Size, 10))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": attachment.Filename}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	w.WriteHeader(http.StatusOK)
+
+	_, err = io.Copy(w, file)
+	if err != nil {
+		logger.Errorf("could not send attachment %d: %s", attachment.ID, err.Error())
+	}
+}
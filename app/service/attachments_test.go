@@ -0,0 +1,267 @@
+package service_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/msanatan/go-chatroom/app/models"
+	"github.com/msanatan/go-chatroom/app/service"
+	"github.com/msanatan/go-chatroom/app/storage"
+)
+
+// testPNG starts like a PNG file, which is all content detection looks at
+var testPNG = append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{0}, 64)...)
+
+// memoryStorage keeps files in memory so tests can check what was stored
+type memoryStorage struct {
+	mutex sync.Mutex
+	files map[string][]byte
+}
+
+func newMemoryStorage() *memoryStorage {
+	return &memoryStorage{files: make(map[string][]byte)}
+}
+
+func (m *memoryStorage) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.files[key] = data
+	return nil
+}
+
+func (m *memoryStorage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	data, ok := m.files[key]
+	if !ok {
+		return nil, storage.ErrNotFound
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (m *memoryStorage) Delete(ctx context.Context, key string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.files, key)
+	return nil
+}
+
+// uploadAs shares a file in a room as the given user, with the form's other fields
+func uploadAs(user models.User, r http.Handler, roomID uint, filename string, content []byte,
+	fields map[string]string) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for name, value := range fields {
+		form.WriteField(name, value)
+	}
+
+	part, _ := form.CreateFormFile("file", filename)
+	part.Write(content)
+	form.Close()
+
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/rooms/%d/attachments", roomID), &body)
+	request.Header.Set("Content-Type", form.FormDataContentType())
+	authenticateAs(int(user.ID), user.Username, r).ServeHTTP(recorder, request)
+	return recorder
+}
+
+func Test_UploadAttachmentNeedsStorage(t *testing.T) {
+	wsServer := service.NewServer(nil, nil, nil, "", "/", testLogger)
+	r := mux.NewRouter()
+	r.HandleFunc("/rooms/{roomId}/attachments", wsServer.UploadAttachment)
+
+	recorder := httptest.NewRecorder()
+	r.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/rooms/1/attachments", nil))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("wrong status code. expected %d but received %d", http.StatusServiceUnavailable, recorder.Code)
+	}
+}
+
+func Test_AttachmentsRejectBadIDs(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		path   string
+	}{
+		{
+			name:   "testing upload to an invalid room",
+			method: http.MethodPost,
+			path:   "/rooms/general/attachments",
+		},
+		{
+			name:   "testing download of an invalid attachment",
+			method: http.MethodGet,
+			path:   "/attachments/mockup.png",
+		},
+	}
+
+	wsServer := service.NewServer(nil, nil, newMemoryStorage(), "", "/", testLogger)
+	r := mux.NewRouter()
+	r.HandleFunc("/rooms/{roomId}/attachments", wsServer.UploadAttachment)
+	r.HandleFunc("/attachments/{id}", wsServer.DownloadAttachment)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			r.ServeHTTP(recorder, httptest.NewRequest(tt.method, tt.path, nil))
+			if recorder.Code != http.StatusBadRequest {
+				t.Errorf("wrong status code. expected %d but received %d", http.StatusBadRequest, recorder.Code)
+			}
+		})
+	}
+}
+
+func Test_AttachmentsAreStoredAndServedToTheRoom(t *testing.T) {
+	chatroomDB := testDB(t)
+	fileStorage := newMemoryStorage()
+	wsServer := service.NewServer(nil, chatroomDB, fileStorage, "", "/", testLogger)
+	go wsServer.Run()
+	r := newTestRouter(wsServer)
+
+	alice := createTestUser(t, chatroomDB, "alice")
+	bob := createTestUser(t, chatroomDB, "bob")
+	room := createTestRoom(t, alice, r, "Design", models.RoomPrivate)
+
+	// The name says it's text, but the content is a picture
+	recorder := uploadAs(alice, r, room.ID, "mockup.txt", testPNG, map[string]string{"message": "New mockup"})
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("could not upload file: %s", recorder.Body.String())
+	}
+
+	var message service.MessagePayload
+	err := json.Unmarshal(recorder.Body.Bytes(), &message)
+	if err != nil || message.Message != "New mockup" || len(message.Attachments) != 1 {
+		t.Fatalf("was expecting the message to have the file but received %+v", message)
+	}
+
+	attachment := message.Attachments[0]
+	if attachment.ContentType != "image/png" || attachment.Filename != "mockup.txt" || attachment.Size != int64(len(testPNG)) {
+		t.Errorf("was expecting a PNG worked out from the content but received %+v", attachment)
+	}
+
+	if len(fileStorage.files) != 1 {
+		t.Fatalf("was expecting 1 stored file but found %d", len(fileStorage.files))
+	}
+
+	for key, data := range fileStorage.files {
+		if !strings.HasPrefix(key, fmt.Sprintf("rooms/%d/", room.ID)) || strings.Contains(key, "mockup") {
+			t.Errorf("was expecting a random key in the room's folder but received %q", key)
+		}
+
+		if !bytes.Equal(data, testPNG) {
+			t.Errorf("the stored file isn't the one uploaded")
+		}
+	}
+
+	downloadPath := fmt.Sprintf("/attachments/%d", attachment.ID)
+	recorder = serveAs(alice, r, http.MethodGet, downloadPath, nil)
+	if recorder.Code != http.StatusOK || !bytes.Equal(recorder.Body.Bytes(), testPNG) {
+		t.Fatalf("was expecting alice to download the file but received %d", recorder.Code)
+	}
+
+	if disposition := recorder.Header().Get("Content-Disposition"); !strings.HasPrefix(disposition, "inline") {
+		t.Errorf("was expecting pictures to be shown inline but received %q", disposition)
+	}
+
+	// Editing the message keeps its file
+	var edited service.MessagePayload
+	serveJSON(t, alice, r, http.MethodPatch, fmt.Sprintf("/messages/%d", message.ID), service.MessagePayload{Message: "Final mockup"},
+		http.StatusOK, &edited)
+	if len(edited.Attachments) != 1 || edited.Attachments[0].ID != attachment.ID {
+		t.Errorf("was expecting the edited message to keep its file but received %+v", edited.Attachments)
+	}
+
+	// bob isn't in the private room
+	recorder = serveAs(bob, r, http.MethodGet, downloadPath, nil)
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("was expecting bob to be kept out but received %d", recorder.Code)
+	}
+
+	recorder = serveAs(alice, r, http.MethodDelete, fmt.Sprintf("/messages/%d", message.ID), nil)
+	if recorder.Code != http.StatusNoContent {
+		t.Fatalf("could not delete message %d: %s", message.ID, recorder.Body.String())
+	}
+
+	recorder = serveAs(alice, r, http.MethodGet, downloadPath, nil)
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("was expecting the file to go with its message but received %d", recorder.Code)
+	}
+}
+
+func Test_UploadAttachmentRemovesFilesItCouldntShare(t *testing.T) {
+	chatroomDB := testDB(t)
+	fileStorage := newMemoryStorage()
+	wsServer := service.NewServer(nil, chatroomDB, fileStorage, "", "/", testLogger)
+	go wsServer.Run()
+	r := newTestRouter(wsServer)
+
+	alice := createTestUser(t, chatroomDB, "alice")
+	room := createTestRoom(t, alice, r, "Design", models.RoomPublic)
+
+	// There's no thread to reply to, so the message can't be saved
+	recorder := uploadAs(alice, r, room.ID, "mockup.png", testPNG, map[string]string{"parentId": "999"})
+	if recorder.Code == http.StatusCreated {
+		t.Fatalf("was expecting the upload to fail without a thread")
+	}
+
+	if len(fileStorage.files) != 0 {
+		t.Errorf("was expecting the file to be removed but found %d stored", len(fileStorage.files))
+	}
+
+	recorder = uploadAs(alice, r, room.ID, "notes.exe", []byte("MZ\x90\x00 not really a program"), nil)
+	if recorder.Code != http.StatusBadRequest || len(fileStorage.files) != 0 {
+		t.Errorf("was expecting programs to be turned away before being stored but received %d", recorder.Code)
+	}
+}
+
+func Test_ArchivedAttachmentsAreStillServed(t *testing.T) {
+	chatroomDB := testDB(t)
+	fileStorage := newMemoryStorage()
+	wsServer := service.NewServer(nil, chatroomDB, fileStorage, "", "/", testLogger)
+	go wsServer.Run()
+	r := newTestRouter(wsServer)
+
+	alice := createTestUser(t, chatroomDB, "alice")
+	room := createTestRoom(t, alice, r, "Design", models.RoomPublic)
+
+	recorder := uploadAs(alice, r, room.ID, "mockup.png", testPNG, nil)
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("could not upload file: %s", recorder.Body.String())
+	}
+
+	var message service.MessagePayload
+	json.Unmarshal(recorder.Body.Bytes(), &message)
+	postTestMessage(t, alice, r, room.ID, "Any thoughts?")
+
+	// Only the latest message is kept, so the one with the file is archived
+	policy := service.RetentionPolicy{Messages: 1, Mode: service.RetentionArchive}
+	janitor := service.NewJanitor(chatroomDB, fileStorage, policy, time.Hour, testLogger)
+	removed, err := janitor.Sweep()
+	if err != nil || removed != 1 {
+		t.Fatalf("was expecting 1 message to be archived but received %d: %v", removed, err)
+	}
+
+	recorder = serveAs(alice, r, http.MethodGet, fmt.Sprintf("/attachments/%d", message.Attachments[0].ID), nil)
+	if recorder.Code != http.StatusOK || !bytes.Equal(recorder.Body.Bytes(), testPNG) {
+		t.Errorf("was expecting the archived message's file to be served but received %d", recorder.Code)
+	}
+}
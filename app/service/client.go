@@ -1,6 +1,9 @@
 package service
 
 import (
+	"encoding/json"
+	"fmt"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -15,92 +18,256 @@ type ClientConfig struct {
 	MaxMessageSize int64
 }
 
+const (
+	// sendBufferSize is how many outgoing messages a client can have queued before
+	// the server considers it too slow and drops it
+	sendBufferSize = 256
+	// maxRoomsPerClient caps how many rooms a single connection can subscribe to
+	maxRoomsPerClient = 50
+)
+
 // WSClient is the websocket client users will connect to
 type WSClient struct {
-	conn   *websocket.Conn
-	server *Server
-	send   chan MessagePayload
-	config *ClientConfig
-	logger *log.Entry
+	conn     *websocket.Conn
+	server   *Server
+	send     chan Envelope
+	config   *ClientConfig
+	userID   uint
+	username string
+	// rooms is the client's own record of what it's subscribed to. The read loop
+	// keeps it up to date, but the hub also drops rooms the user is evicted from
+	rooms      map[uint]bool
+	roomsMutex sync.Mutex
+	logger     *log.Entry
 }
 
 // Subscription is a struct to encapsulates a client connection
-// and the room it's connecting to
+// and a room it's subscribing to or unsubscribing from.
+// Since is the last message sequence number the client saw, if it's resuming
 type Subscription struct {
 	Client *WSClient
 	RoomID uint
+	Since  uint64
+}
+
+// clientMessage is a message meant for one client only, like an acknowledgement
+type clientMessage struct {
+	client  *WSClient
+	message Envelope
+}
+
+// usersMessage is a message meant for all the connections of some users.
+// The except connection is skipped, usually because it sent the update.
+// With subscribedOnly set, only connections subscribed to the message's room get it
+type usersMessage struct {
+	userIDs        []uint
+	except         *WSClient
+	subscribedOnly bool
+	message        Envelope
 }
 
 // NewWSClient instantiates a new websocket client
-func NewWSClient(conn *websocket.Conn, server *Server, config *ClientConfig, logger *log.Entry) *WSClient {
+func NewWSClient(conn *websocket.Conn, server *Server, config *ClientConfig,
+	userID uint, username string, logger *log.Entry) *WSClient {
 	return &WSClient{
-		conn:   conn,
-		server: server,
-		config: config,
-		send:   make(chan MessagePayload),
-		logger: logger,
+		conn:     conn,
+		server:   server,
+		config:   config,
+		send:     make(chan Envelope, sendBufferSize),
+		userID:   userID,
+		username: username,
+		rooms:    make(map[uint]bool),
+		logger:   logger,
 	}
 }
 
-func (s *Subscription) disconnect() {
-	logger := s.Client.logger.WithField("method", "disconnect")
-	s.Client.server.Deregister <- s
-	close(s.Client.send)
-	s.Client.conn.Close()
+func (c *WSClient) disconnect() {
+	logger := c.logger.WithField("method", "disconnect")
+	// The server closes the send channel once the client is deregistered
+	c.server.Deregister <- c
+	c.conn.Close()
 	logger.Debug("disconnecting client")
 }
 
-func (s *Subscription) readMessages() {
-	logger := s.Client.logger.WithField("method", "readMessages")
+// subscribe starts delivering a room's events to the client, after replaying
+// the messages that came after since
+func (c *WSClient) subscribe(roomID uint, since uint64) {
+	c.roomsMutex.Lock()
+	c.rooms[roomID] = true
+	c.roomsMutex.Unlock()
+	c.server.subscribe <- &Subscription{
+		Client: c,
+		RoomID: roomID,
+		Since:  since,
+	}
+}
+
+// unsubscribe stops delivering a room's events to the client
+func (c *WSClient) unsubscribe(roomID uint) {
+	c.forgetRoom(roomID)
+	c.server.unsubscribe <- &Subscription{
+		Client: c,
+		RoomID: roomID,
+	}
+}
+
+// forgetRoom drops a room from the client's subscriptions without telling the hub
+func (c *WSClient) forgetRoom(roomID uint) {
+	c.roomsMutex.Lock()
+	defer c.roomsMutex.Unlock()
+	delete(c.rooms, roomID)
+}
+
+// isSubscribed checks if the client is subscribed to a room
+func (c *WSClient) isSubscribed(roomID uint) bool {
+	c.roomsMutex.Lock()
+	defer c.roomsMutex.Unlock()
+	return c.rooms[roomID]
+}
+
+// canSubscribe checks if the client has room for one more subscription
+func (c *WSClient) canSubscribe(roomID uint) bool {
+	c.roomsMutex.Lock()
+	defer c.roomsMutex.Unlock()
+	return len(c.rooms) < maxRoomsPerClient || c.rooms[roomID]
+}
+
+func (c *WSClient) readMessages() {
+	logger := c.logger.WithField("method", "readMessages")
 	defer func() {
-		s.disconnect()
+		c.disconnect()
 	}()
 
-	s.Client.conn.SetReadLimit(s.Client.config.MaxMessageSize)
-	s.Client.conn.SetReadDeadline(time.Now().Add(s.Client.config.PongWait))
-	s.Client.conn.SetPongHandler(func(string) error {
-		s.Client.conn.SetReadDeadline(time.Now().Add(s.Client.config.PongWait))
+	c.conn.SetReadLimit(c.config.MaxMessageSize)
+	c.conn.SetReadDeadline(time.Now().Add(c.config.PongWait))
+	c.conn.SetPongHandler(func(string) error {
+		c.conn.SetReadDeadline(time.Now().Add(c.config.PongWait))
 		return nil
 	})
 
 	// Start endless read loop, waiting for messages from client
 	for {
-		var message MessagePayload
-		err := s.Client.conn.ReadJSON(&message)
+		_, frame, err := c.conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				logger.Errorf("unexpected close error: %s", err.Error())
 			}
 			break
 		}
+
+		var envelope Envelope
+		err = json.Unmarshal(frame, &envelope)
+		if err != nil {
+			logger.Errorf("frame is not a valid envelope: %s", err.Error())
+			c.replyError(envelope, &ErrorPayload{
+				Code:    ErrCodeInvalidFrame,
+				Message: "frames must be JSON envelopes",
+			})
+			continue
+		}
+
+		c.dispatch(envelope)
+	}
+}
+
+// handleSubscribe adds the room in the frame to the client's subscriptions
+func handleSubscribe(c *WSClient, envelope Envelope) (interface{}, error) {
+	if envelope.RoomID == 0 {
+		return nil, errMissingRoom
+	}
+
+	// The payload is optional, it's only needed to resume a subscription
+	var request SubscribePayload
+	if len(envelope.Payload) > 0 {
+		err := decodePayload(envelope, &request)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !c.canSubscribe(envelope.RoomID) {
+		return nil, fmt.Errorf("a connection can't be subscribed to more than %d rooms", maxRoomsPerClient)
+	}
+
+	err := c.server.joinRoom(c.userID, envelope.RoomID)
+	if err != nil {
+		return nil, err
+	}
+
+	c.subscribe(envelope.RoomID, request.Since)
+	return AckPayload{}, nil
+}
+
+// handleUnsubscribe removes the room in the frame from the client's subscriptions
+func handleUnsubscribe(c *WSClient, envelope Envelope) (interface{}, error) {
+	if envelope.RoomID == 0 {
+		return nil, errMissingRoom
+	}
+
+	c.unsubscribe(envelope.RoomID)
+	return AckPayload{}, nil
+}
+
+// handleMessage saves a message received over the websocket, acknowledging it
+// with the ID and timestamp it was stored with
+func handleMessage(c *WSClient, envelope Envelope) (interface{}, error) {
+	var message MessagePayload
+	err := decodePayload(envelope, &message)
+	if err != nil {
+		return nil, err
+	}
+
+	// Clients can only post to rooms they're subscribed to
+	if !c.isSubscribed(envelope.RoomID) {
+		return nil, errNotSubscribed
+	}
+
+	message.RoomID = envelope.RoomID
+	saved, err := c.server.persistMessage(c.userID, c.username, message, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return AckPayload{
+		ID:      saved.ID,
+		Seq:     saved.Seq,
+		Created: saved.Created,
+	}, nil
+}
+
+// reply sends a frame to this client only
+func (c *WSClient) reply(message Envelope) {
+	c.server.direct <- &clientMessage{
+		client:  c,
+		message: message,
 	}
 }
 
-func (s *Subscription) writeMessages() {
-	logger := s.Client.logger.WithField("method", "writeMessages")
-	ticker := time.NewTicker(s.Client.config.PingPeriod)
+func (c *WSClient) writeMessages() {
+	logger := c.logger.WithField("method", "writeMessages")
+	ticker := time.NewTicker(c.config.PingPeriod)
 	defer func() {
 		ticker.Stop()
-		s.Client.conn.Close()
+		c.conn.Close()
 	}()
 	for {
 		select {
-		case message, ok := <-s.Client.send:
-			s.Client.conn.SetWriteDeadline(time.Now().Add(s.Client.config.WriteWait))
+		case message, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(c.config.WriteWait))
 			if !ok {
 				// The WsServer closed the channel.
-				s.Client.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
 				return
 			}
 
-			err := s.Client.conn.WriteJSON(message)
+			err := c.conn.WriteJSON(message)
 			if err != nil {
 				logger.Errorf("error sending message: %s", err.Error())
 				return
 			}
 		case <-ticker.C:
-			s.Client.conn.SetWriteDeadline(time.Now().Add(s.Client.config.WriteWait))
-			if err := s.Client.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+			c.conn.SetWriteDeadline(time.Now().Add(c.config.WriteWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
 				logger.Errorf("unable to send ping: %s", err.Error())
 				return
 			}
@@ -0,0 +1,132 @@
+package service_test
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/gorilla/mux"
+	_ "github.com/lib/pq"
+	"github.com/msanatan/go-chatroom/app/models"
+	"github.com/msanatan/go-chatroom/app/service"
+)
+
+// testTables are emptied before every test that uses the database
+const testTables = "rooms, messages, users, message_edits, reactions, room_memberships, mentions, pins, attachments, archived_messages"
+
+var testChatroomDB *models.ChatroomDB
+
+// testDB connects to the Postgres database in TEST_DATABASE_URL, migrating it the first
+// time. Tests that need a database are skipped without one. Every table is emptied, so
+// each test starts from scratch
+func testDB(t *testing.T) *models.ChatroomDB {
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL isn't set")
+	}
+
+	if testChatroomDB == nil {
+		db, err := sql.Open("postgres", dsn)
+		if err != nil {
+			t.Fatalf("could not connect to the database: %s", err.Error())
+		}
+
+		chatroomDB, err := models.NewChatroomDB(db, testLogger)
+		if err != nil {
+			t.Fatalf("could not connect to the database: %s", err.Error())
+		}
+
+		err = chatroomDB.Migrate()
+		if err != nil {
+			t.Fatalf("could not migrate the database: %s", err.Error())
+		}
+		testChatroomDB = chatroomDB
+	}
+
+	err := testChatroomDB.DB.Exec("TRUNCATE " + testTables + " RESTART IDENTITY").Error
+	if err != nil {
+		t.Fatalf("could not empty the database: %s", err.Error())
+	}
+
+	return testChatroomDB
+}
+
+// newTestRouter routes the API like the app does, without authentication
+func newTestRouter(wsServer *service.Server) *mux.Router {
+	r := mux.NewRouter()
+	r.HandleFunc("/rooms/{roomId}/messages", wsServer.GetLastMessages).Methods("GET")
+	r.HandleFunc("/rooms/{roomId}/export", wsServer.ExportRoomHistory).Methods("GET")
+	r.HandleFunc("/rooms", wsServer.GetRooms).Methods("GET")
+	r.HandleFunc("/rooms", wsServer.CreateRoom).Methods("POST")
+	r.HandleFunc("/rooms/{roomId}/attachments", wsServer.UploadAttachment).Methods("POST")
+	r.HandleFunc("/attachments/{id}", wsServer.DownloadAttachment).Methods("GET")
+	r.HandleFunc("/dms", wsServer.CreateDirectConversation).Methods("POST")
+	r.HandleFunc("/search/messages", wsServer.SearchMessages).Methods("GET")
+	r.HandleFunc("/messages", wsServer.CreateMessage).Methods("POST")
+	r.HandleFunc("/messages/{id}", wsServer.EditMessage).Methods("PATCH")
+	r.HandleFunc("/messages/{id}", wsServer.DeleteMessage).Methods("DELETE")
+	return r
+}
+
+// serveAs sends a request to the API as the given user
+func serveAs(user models.User, r http.Handler, method, path string, body io.Reader) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	authenticateAs(int(user.ID), user.Username, r).ServeHTTP(recorder, httptest.NewRequest(method, path, body))
+	return recorder
+}
+
+// serveJSON sends a JSON request to the API as the given user, decoding the response into result.
+// The test fails if the response doesn't have the expected status code
+func serveJSON(t *testing.T, user models.User, r http.Handler, method, path string, request interface{},
+	statusCode int, result interface{}) {
+	var body io.Reader
+	if request != nil {
+		requestJSON, _ := json.Marshal(request)
+		body = bytes.NewReader(requestJSON)
+	}
+
+	recorder := serveAs(user, r, method, path, body)
+	if recorder.Code != statusCode {
+		t.Fatalf("%s %s: expected %d but received %d: %s", method, path, statusCode, recorder.Code, recorder.Body.String())
+	}
+
+	if result != nil {
+		err := json.Unmarshal(recorder.Body.Bytes(), result)
+		if err != nil {
+			t.Fatalf("%s %s: response is not valid JSON: %s", method, path, err.Error())
+		}
+	}
+}
+
+// createTestUser saves a user that requests can be sent as
+func createTestUser(t *testing.T, chatroomDB *models.ChatroomDB, username string) models.User {
+	user := models.User{Username: username, Email: username + "@example.com", Password: "secret"}
+	user.Init()
+	err := chatroomDB.DB.Create(&user).Error
+	if err != nil {
+		t.Fatalf("could not create user %s: %s", username, err.Error())
+	}
+
+	return user
+}
+
+// createTestRoom creates a room through the API, owned by the given user
+func createTestRoom(t *testing.T, owner models.User, r http.Handler, name, visibility string) service.RoomPayload {
+	var room service.RoomPayload
+	serveJSON(t, owner, r, http.MethodPost, "/rooms", service.RoomRequest{Name: name, Visibility: visibility},
+		http.StatusCreated, &room)
+	return room
+}
+
+// postTestMessage sends a message to a room through the API. The server's hub must be running
+func postTestMessage(t *testing.T, author models.User, r http.Handler, roomID uint, text string) service.MessagePayload {
+	var message service.MessagePayload
+	serveJSON(t, author, r, http.MethodPost, "/messages", service.MessagePayload{Message: text, Type: "user", RoomID: roomID},
+		http.StatusCreated, &message)
+	return message
+}
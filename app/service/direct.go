@@ -0,0 +1,159 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/msanatan/go-chatroom/app/models"
+	"github.com/msanatan/go-chatroom/utils"
+	"gorm.io/gorm"
+)
+
+// maxDirectMembers caps how many users can be in a direct conversation, including its creator
+const maxDirectMembers = 8
+
+// CreateDirectConversation finds the direct conversation between the requester and
+// the given users, creating it if they never talked before
+func (s *Server) CreateDirectConversation(w http.ResponseWriter, r *http.Request) {
+	logger := s.logger.WithField("method", "CreateDirectConversation")
+
+	var request DirectConversationRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		logger.Errorf("could not unmarshal request body: %s", err.Error())
+		utils.WriteErrorResponse(w, http.StatusBadRequest, err)
+		return
+	}
+
+	userID, username := userFromContext(r.Context())
+	usernames := map[string]bool{username: true}
+	for _, name := range request.Usernames {
+		usernames[strings.TrimSpace(name)] = true
+	}
+
+	if len(usernames) < 2 {
+		utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("you need someone else to talk to"))
+		return
+	}
+
+	if len(usernames) > maxDirectMembers {
+		utils.WriteErrorResponse(w, http.StatusBadRequest,
+			fmt.Errorf("direct conversations can't have more than %d people", maxDirectMembers))
+		return
+	}
+
+	var names []string
+	for name := range usernames {
+		names = append(names, name)
+	}
+
+	var users []models.User
+	tx := s.chatroomDB.DB.Where("username IN ?", names).Find(&users)
+	if tx.Error != nil {
+		logger.Errorf("could not find users: %s", tx.Error.Error())
+		utils.WriteErrorResponse(w, http.StatusBadRequest,
+			errors.New("could not start the conversation at this time, please try again"))
+		return
+	}
+
+	if len(users) != len(names) {
+		utils.WriteErrorResponse(w, http.StatusNotFound, errors.New("some of those users don't exist"))
+		return
+	}
+
+	room, created, err := s.findOrCreateDirectRoom(users)
+	if err != nil {
+		logger.Errorf("could not find or create conversation for user %d: %s", userID, err.Error())
+		utils.WriteErrorResponse(w, http.StatusBadRequest,
+			errors.New("could not start the conversation at this time, please try again"))
+		return
+	}
+
+	roomsPayload := []RoomPayload{newRoomPayload(room)}
+	err = s.attachMembers(roomsPayload)
+	if err != nil {
+		logger.Errorf("could not list conversation members: %s", err.Error())
+	}
+	responsePayload := roomsPayload[0]
+
+	statusCode := http.StatusOK
+	if created {
+		statusCode = http.StatusCreated
+	}
+
+	resp, _ := json.Marshal(&responsePayload)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	w.Write(resp)
+}
+
+// findOrCreateDirectRoom returns the direct conversation between exactly these users,
+// creating it along with their memberships if needed
+func (s *Server) findOrCreateDirectRoom(users []models.User) (models.Room, bool, error) {
+	var userIDs []uint
+	var usernames []string
+	for _, user := range users {
+		userIDs = append(userIDs, user.ID)
+		usernames = append(usernames, user.Username)
+	}
+	sort.Strings(usernames)
+	directKey := models.DirectKeyFor(userIDs)
+
+	var room models.Room
+	tx := s.chatroomDB.DB.Where("direct_key = ?", directKey).First(&room)
+	if tx.Error == nil {
+		return room, false, nil
+	}
+
+	if !errors.Is(tx.Error, gorm.ErrRecordNotFound) {
+		return room, false, tx.Error
+	}
+
+	room = models.Room{
+		Name:      strings.Join(usernames, ", "),
+		Kind:      models.RoomKindDirect,
+		DirectKey: &directKey,
+	}
+	room.Init()
+	err := room.Validate()
+	if err != nil {
+		return room, false, err
+	}
+
+	err = s.chatroomDB.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Create(&room).Error
+		if err != nil {
+			return err
+		}
+
+		for _, userID := range userIDs {
+			membership := models.RoomMembership{
+				RoomID: room.ID,
+				UserID: userID,
+			}
+			membership.Init()
+
+			err = tx.Create(&membership).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		// Someone else may have started the same conversation at the same time
+		retry := s.chatroomDB.DB.Where("direct_key = ?", directKey).First(&room)
+		if retry.Error == nil {
+			return room, false, nil
+		}
+
+		return room, false, err
+	}
+
+	return room, true, nil
+}
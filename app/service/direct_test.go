@@ -0,0 +1,102 @@
+package service_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/msanatan/go-chatroom/app/models"
+	"github.com/msanatan/go-chatroom/app/service"
+)
+
+func Test_CreateDirectConversationRejectsBadMembers(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{
+			name: "testing invalid body",
+			body: `{"usernames": "bob"}`,
+		},
+		{
+			name: "testing nobody else",
+			body: `{"usernames": []}`,
+		},
+		{
+			name: "testing only yourself",
+			body: `{"usernames": ["alice", "alice"]}`,
+		},
+		{
+			name: "testing too many people",
+			body: `{"usernames": ["b", "c", "d", "e", "f", "g", "h", "i"]}`,
+		},
+	}
+
+	wsServer := service.NewServer(nil, nil, nil, "", "/", testLogger)
+	r := mux.NewRouter()
+	r.HandleFunc("/dms", wsServer.CreateDirectConversation)
+	handler := authenticateAs(1, "alice", r)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/dms", strings.NewReader(tt.body)))
+			if recorder.Code != http.StatusBadRequest {
+				t.Errorf("wrong status code. expected %d but received %d", http.StatusBadRequest, recorder.Code)
+			}
+		})
+	}
+}
+
+func Test_DirectConversationsAreSharedByTheirMembers(t *testing.T) {
+	chatroomDB := testDB(t)
+	wsServer := service.NewServer(nil, chatroomDB, nil, "", "/", testLogger)
+	go wsServer.Run()
+	r := newTestRouter(wsServer)
+
+	alice := createTestUser(t, chatroomDB, "alice")
+	bob := createTestUser(t, chatroomDB, "bob")
+	carol := createTestUser(t, chatroomDB, "carol")
+
+	var conversation service.RoomPayload
+	serveJSON(t, alice, r, http.MethodPost, "/dms", service.DirectConversationRequest{Usernames: []string{"bob"}},
+		http.StatusCreated, &conversation)
+	if conversation.Kind != models.RoomKindDirect || conversation.Visibility != models.RoomPrivate {
+		t.Errorf("was expecting a private direct conversation but received %+v", conversation)
+	}
+
+	if !reflect.DeepEqual(conversation.Members, []string{"alice", "bob"}) {
+		t.Errorf("was expecting alice and bob to be the members but found %v", conversation.Members)
+	}
+
+	// bob starting a conversation with alice finds the one she started
+	var found service.RoomPayload
+	serveJSON(t, bob, r, http.MethodPost, "/dms", service.DirectConversationRequest{Usernames: []string{"alice"}},
+		http.StatusOK, &found)
+	if found.ID != conversation.ID {
+		t.Errorf("was expecting bob to get conversation %d but received %d", conversation.ID, found.ID)
+	}
+
+	var group service.RoomPayload
+	serveJSON(t, alice, r, http.MethodPost, "/dms", service.DirectConversationRequest{Usernames: []string{"bob", "carol"}},
+		http.StatusCreated, &group)
+	if group.ID == conversation.ID {
+		t.Errorf("was expecting a conversation with carol to be a new one")
+	}
+
+	sent := postTestMessage(t, alice, r, conversation.ID, "just between us")
+	var history service.MessagesPayload
+	serveJSON(t, bob, r, http.MethodGet, fmt.Sprintf("/rooms/%d/messages", conversation.ID), nil, http.StatusOK, &history)
+	if history.Size != 1 || history.Messages[0].ID != sent.ID {
+		t.Errorf("was expecting bob to read alice's message but received %+v", history.Messages)
+	}
+
+	recorder := serveAs(carol, r, http.MethodGet, fmt.Sprintf("/rooms/%d/messages", conversation.ID), nil)
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("was expecting carol to be kept out of the conversation but received %d", recorder.Code)
+	}
+}
@@ -0,0 +1,174 @@
+package service
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/msanatan/go-chatroom/app/models"
+	"gorm.io/gorm"
+)
+
+// previewLength caps how much of a room's last message is shown in the directory, in characters
+const previewLength = 100
+
+// Directory sort orders
+const (
+	SortCreated  = "created"
+	SortName     = "name"
+	SortActivity = "activity"
+	SortMembers  = "members"
+)
+
+// memberCountSQL counts a room's active members
+const memberCountSQL = "(SELECT COUNT(*) FROM room_memberships WHERE room_memberships.room_id = rooms.id AND room_memberships.status = '" +
+	models.MembershipActive + "')"
+
+// directoryQuery describes which page of the room directory a client wants
+type directoryQuery struct {
+	search string
+	sort   string
+	offset int
+	limit  int
+}
+
+// parseDirectoryQuery reads the q, sort, offset and limit query parameters
+func parseDirectoryQuery(values url.Values) (directoryQuery, error) {
+	query := directoryQuery{
+		search: strings.TrimSpace(values.Get("q")),
+		sort:   SortCreated,
+		limit:  defaultPageSize,
+	}
+
+	if sort := values.Get("sort"); sort != "" {
+		if sort != SortCreated && sort != SortName && sort != SortActivity && sort != SortMembers {
+			return query, errors.New("sort must be created, name, activity or members")
+		}
+		query.sort = sort
+	}
+
+	if offset := values.Get("offset"); offset != "" {
+		start, err := strconv.Atoi(offset)
+		if err != nil || start < 0 {
+			return query, errors.New("offset must be a positive number")
+		}
+		query.offset = start
+	}
+
+	if limit := values.Get("limit"); limit != "" {
+		size, err := strconv.Atoi(limit)
+		if err != nil || size < 1 {
+			return query, errors.New("limit must be a positive number")
+		}
+		query.limit = size
+	}
+
+	if query.limit > maxPageSize {
+		query.limit = maxPageSize
+	}
+
+	return query, nil
+}
+
+// findRoomsPage runs a room query for one page of the directory, returning the
+// offset of the next page, which is 0 when there's nothing more to fetch
+func findRoomsPage(tx *gorm.DB, query directoryQuery) ([]models.Room, int, error) {
+	if query.search != "" {
+		pattern := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(query.search) + "%"
+		tx = tx.Where("rooms.name ILIKE ? OR rooms.topic ILIKE ?", pattern, pattern)
+	}
+
+	switch query.sort {
+	case SortName:
+		tx = tx.Order("rooms.name asc")
+	case SortActivity:
+		tx = tx.Order("rooms.last_message_at desc nulls last")
+	case SortMembers:
+		tx = tx.Order(memberCountSQL + " desc")
+	}
+
+	// Fetch an extra room to find out if there's another page
+	var rooms []models.Room
+	err := tx.Order("rooms.id asc").Offset(query.offset).Limit(query.limit + 1).Find(&rooms).Error
+	if err != nil {
+		return nil, 0, err
+	}
+
+	nextOffset := 0
+	if len(rooms) > query.limit {
+		rooms = rooms[:query.limit]
+		nextOffset = query.offset + query.limit
+	}
+
+	return rooms, nextOffset, nil
+}
+
+// attachActivity adds each room's member count, the user's unread count, and a preview
+// of the room's last message to their payloads
+func (s *Server) attachActivity(rooms []RoomPayload, userID uint) error {
+	if len(rooms) == 0 {
+		return nil
+	}
+
+	var roomIDs []uint
+	byID := make(map[uint]*RoomPayload)
+	for i := range rooms {
+		roomIDs = append(roomIDs, rooms[i].ID)
+		byID[rooms[i].ID] = &rooms[i]
+	}
+
+	var memberCounts []struct {
+		RoomID uint
+		Count  int64
+	}
+	tx := s.chatroomDB.DB.Model(&models.RoomMembership{}).Select("room_id, COUNT(*) AS count").
+		Where("room_id IN ? AND status = ?", roomIDs, models.MembershipActive).Group("room_id").Scan(&memberCounts)
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	for _, count := range memberCounts {
+		byID[count.RoomID].MemberCount = count.Count
+	}
+
+	// Only members have a record of what they read, and their own messages are never unread
+	var unreadCounts []struct {
+		RoomID uint
+		Count  int64
+	}
+	tx = s.chatroomDB.DB.Model(&models.Message{}).Select("messages.room_id, COUNT(*) AS count").
+		Joins("JOIN room_memberships ON room_memberships.room_id = messages.room_id AND room_memberships.user_id = ?", userID).
+		Where("messages.room_id IN ? AND room_memberships.status = ? AND messages.seq > room_memberships.last_read_seq", roomIDs, models.MembershipActive).
+		Where("messages.parent_id IS NULL AND messages.user_id <> ?", userID).
+		Group("messages.room_id").Scan(&unreadCounts)
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	for _, count := range unreadCounts {
+		byID[count.RoomID].UnreadCount = count.Count
+	}
+
+	var lastMessages []models.Message
+	tx = s.chatroomDB.DB.Where("id IN (?)", s.chatroomDB.DB.Model(&models.Message{}).Select("MAX(id)").
+		Where("room_id IN ? AND parent_id IS NULL", roomIDs).Group("room_id")).Preload("User").Find(&lastMessages)
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	for _, message := range lastMessages {
+		preview := newMessagePayload(message)
+		if utf8.RuneCountInString(preview.Message) > previewLength {
+			preview.Message = string([]rune(preview.Message)[:previewLength]) + "…"
+		}
+
+		room := byID[message.RoomID]
+		room.LastMessage = &preview
+		room.LastMessageAt = message.CreatedAt.Format(time.RFC1123Z)
+	}
+
+	return nil
+}
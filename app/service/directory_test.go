@@ -0,0 +1,105 @@
+package service_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/msanatan/go-chatroom/app/models"
+	"github.com/msanatan/go-chatroom/app/service"
+)
+
+// roomNames lists the names of a page of the directory, in order
+func roomNames(page service.RoomsPayload) []string {
+	names := []string{}
+	for _, room := range page.Rooms {
+		names = append(names, room.Name)
+	}
+
+	return names
+}
+
+func Test_GetRoomsRejectsBadQueries(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+	}{
+		{
+			name:  "testing unknown sort",
+			query: "?sort=popularity",
+		},
+		{
+			name:  "testing negative offset",
+			query: "?offset=-50",
+		},
+		{
+			name:  "testing invalid limit",
+			query: "?limit=0",
+		},
+	}
+
+	wsServer := service.NewServer(nil, nil, nil, "", "/", testLogger)
+	r := mux.NewRouter()
+	r.HandleFunc("/rooms", wsServer.GetRooms)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			r.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/rooms"+tt.query, nil))
+			if recorder.Code != http.StatusBadRequest {
+				t.Errorf("wrong status code. expected %d but received %d", http.StatusBadRequest, recorder.Code)
+			}
+		})
+	}
+}
+
+func Test_RoomDirectoryPagesSearchesAndSorts(t *testing.T) {
+	chatroomDB := testDB(t)
+	wsServer := service.NewServer(nil, chatroomDB, nil, "", "/", testLogger)
+	go wsServer.Run()
+	r := newTestRouter(wsServer)
+
+	alice := createTestUser(t, chatroomDB, "alice")
+	bob := createTestUser(t, chatroomDB, "bob")
+
+	createTestRoom(t, alice, r, "Random", models.RoomPublic)
+	general := createTestRoom(t, alice, r, "General", models.RoomPublic)
+	createTestRoom(t, alice, r, "Secret plans", models.RoomPrivate)
+	var gophers service.RoomPayload
+	serveJSON(t, alice, r, http.MethodPost, "/rooms", service.RoomRequest{Name: "Backend", Topic: "For gophers only"},
+		http.StatusCreated, &gophers)
+
+	// bob only sees the public rooms, in the order they were made
+	var page service.RoomsPayload
+	serveJSON(t, bob, r, http.MethodGet, "/rooms?limit=2", nil, http.StatusOK, &page)
+	if names := roomNames(page); len(names) != 2 || names[0] != "Random" || names[1] != "General" || page.NextOffset != 2 {
+		t.Errorf("was expecting the first page to be Random and General but received %v, next offset %d", names, page.NextOffset)
+	}
+
+	serveJSON(t, bob, r, http.MethodGet, "/rooms?limit=2&offset=2", nil, http.StatusOK, &page)
+	if names := roomNames(page); len(names) != 1 || names[0] != "Backend" || page.NextOffset != 0 {
+		t.Errorf("was expecting the last page to be Backend but received %v, next offset %d", names, page.NextOffset)
+	}
+
+	serveJSON(t, alice, r, http.MethodGet, "/rooms?sort=name", nil, http.StatusOK, &page)
+	if names := roomNames(page); len(names) != 4 || names[0] != "Backend" || names[3] != "Secret plans" {
+		t.Errorf("was expecting alice to see every room by name but received %v", names)
+	}
+
+	serveJSON(t, bob, r, http.MethodGet, "/rooms?q=GOPHER", nil, http.StatusOK, &page)
+	if names := roomNames(page); len(names) != 1 || names[0] != "Backend" {
+		t.Errorf("was expecting the search to match Backend's topic but received %v", names)
+	}
+
+	postTestMessage(t, alice, r, general.ID, "Good morning")
+	serveJSON(t, bob, r, http.MethodGet, "/rooms?sort=activity", nil, http.StatusOK, &page)
+	if len(page.Rooms) == 0 || page.Rooms[0].ID != general.ID {
+		t.Fatalf("was expecting General to be the most active room but received %v", roomNames(page))
+	}
+
+	latest := page.Rooms[0]
+	if latest.LastMessage == nil || latest.LastMessage.Message != "Good morning" || latest.MemberCount != 1 {
+		t.Errorf("was expecting General's activity to show alice's message and 1 member but received %+v", latest)
+	}
+}
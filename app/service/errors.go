@@ -0,0 +1,53 @@
+package service
+
+import (
+	"net/http"
+
+	"github.com/msanatan/go-chatroom/utils"
+)
+
+// statusError is an error that knows which HTTP status it should be reported with.
+// It lets the HTTP and websocket APIs share the same logic
+type statusError struct {
+	status  int
+	message string
+}
+
+func (e *statusError) Error() string {
+	return e.message
+}
+
+// newStatusError creates an error that's reported with the given HTTP status
+func newStatusError(status int, message string) *statusError {
+	return &statusError{
+		status:  status,
+		message: message,
+	}
+}
+
+// writeStatusError writes an error response, using the error's own status if it has one
+func writeStatusError(w http.ResponseWriter, fallbackStatus int, err error) {
+	if statusErr, ok := err.(*statusError); ok {
+		utils.WriteErrorResponse(w, statusErr.status, statusErr)
+		return
+	}
+
+	utils.WriteErrorResponse(w, fallbackStatus, err)
+}
+
+// errorCode picks the protocol error code matching an error's HTTP status
+func errorCode(err error) string {
+	statusErr, ok := err.(*statusError)
+	if !ok {
+		return ErrCodeRejected
+	}
+
+	switch statusErr.status {
+	case http.StatusNotFound:
+		return ErrCodeNotFound
+	case http.StatusForbidden:
+		return ErrCodeForbidden
+	default:
+		return ErrCodeRejected
+	}
+}
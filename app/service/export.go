@@ -0,0 +1,328 @@
+package service
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/msanatan/go-chatroom/app/models"
+	"github.com/msanatan/go-chatroom/utils"
+	"gorm.io/gorm"
+)
+
+// Export formats
+const (
+	ExportJSON = "json"
+	ExportCSV  = "csv"
+	ExportText = "txt"
+)
+
+// exportBatchSize is how many messages are loaded at a time while exporting, so
+// rooms of any size can be exported without holding their history in memory
+const exportBatchSize = 500
+
+// exportContentTypes are the content types exports are served with
+var exportContentTypes = map[string]string{
+	ExportJSON: "application/json",
+	ExportCSV:  "text/csv; charset=utf-8",
+	ExportText: "text/plain; charset=utf-8",
+}
+
+// ExportOptions picks which of a room's messages are exported, and in what format
+type ExportOptions struct {
+	Format string
+	From   *time.Time
+	To     *time.Time
+}
+
+// ParseExportOptions reads an export's format and period. Both ends of the period are
+// optional, and take the same dates as message search. The format defaults to JSON
+func ParseExportOptions(format, from, to string) (ExportOptions, error) {
+	options := ExportOptions{Format: format}
+	if options.Format == "" {
+		options.Format = ExportJSON
+	}
+
+	if _, ok := exportContentTypes[options.Format]; !ok {
+		return options, errors.New("format must be json, csv or txt")
+	}
+
+	if from != "" {
+		date, err := parseSearchTime(from, false)
+		if err != nil {
+			return options, errors.New("from must be a date like 2021-03-14 or 2021-03-14T15:09:26Z")
+		}
+		options.From = &date
+	}
+
+	if to != "" {
+		date, err := parseSearchTime(to, true)
+		if err != nil {
+			return options, errors.New("to must be a date like 2021-03-14 or 2021-03-14T15:09:26Z")
+		}
+		options.To = &date
+	}
+
+	if options.From != nil && options.To != nil && options.To.Before(*options.From) {
+		return options, errors.New("to can't be before from")
+	}
+
+	return options, nil
+}
+
+// ExportFilename names the file a room's export is saved to
+func ExportFilename(room models.Room, format string) string {
+	name := "direct-" + strconv.FormatUint(uint64(room.ID), 10)
+	if room.Slug != nil {
+		name = *room.Slug
+	}
+
+	return name + "." + format
+}
+
+// describeAttachment sums up a file shared in a message for the CSV and text exports
+func describeAttachment(attachment models.Attachment) string {
+	payload := newAttachmentPayload(attachment)
+	return fmt.Sprintf("%s (%s, %d bytes) %s", payload.Filename, payload.ContentType, payload.Size, payload.URL)
+}
+
+// exportWriter writes messages in one of the export formats
+type exportWriter interface {
+	begin(room models.Room) error
+	write(message models.Message) error
+	end() error
+}
+
+// jsonExportWriter writes the room and its messages as one JSON document
+type jsonExportWriter struct {
+	w     io.Writer
+	count int
+}
+
+func (e *jsonExportWriter) begin(room models.Room) error {
+	roomJSON, err := json.Marshal(newRoomPayload(room))
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(e.w, "{\"room\":%s,\"messages\":[\n", roomJSON)
+	return err
+}
+
+func (e *jsonExportWriter) write(message models.Message) error {
+	messageJSON, err := json.Marshal(newMessagePayload(message))
+	if err != nil {
+		return err
+	}
+
+	if e.count > 0 {
+		_, err = io.WriteString(e.w, ",\n")
+		if err != nil {
+			return err
+		}
+	}
+	e.count++
+
+	_, err = e.w.Write(messageJSON)
+	return err
+}
+
+func (e *jsonExportWriter) end() error {
+	_, err := io.WriteString(e.w, "\n]}\n")
+	return err
+}
+
+// csvExportWriter writes a row for every message, after a header row
+type csvExportWriter struct {
+	w *csv.Writer
+}
+
+func (e *csvExportWriter) begin(room models.Room) error {
+	return e.w.Write([]string{"id", "seq", "created", "username", "type", "parent_id", "edited", "message", "attachments"})
+}
+
+func (e *csvExportWriter) write(message models.Message) error {
+	payload := newMessagePayload(message)
+	parentID := ""
+	if payload.ParentID != 0 {
+		parentID = strconv.FormatUint(uint64(payload.ParentID), 10)
+	}
+
+	// Each file goes on a line of its own within the cell
+	var attachments []string
+	for _, attachment := range message.Attachments {
+		attachments = append(attachments, describeAttachment(attachment))
+	}
+
+	err := e.w.Write([]string{
+		strconv.FormatUint(uint64(payload.ID), 10),
+		strconv.FormatUint(payload.Seq, 10),
+		payload.Created,
+		payload.Username,
+		payload.Type,
+		parentID,
+		payload.Edited,
+		payload.Message,
+		strings.Join(attachments, "\n"),
+	})
+	if err != nil {
+		return err
+	}
+
+	// Flush every row, so the export streams instead of building up in the CSV writer
+	e.w.Flush()
+	return e.w.Error()
+}
+
+func (e *csvExportWriter) end() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+// textExportWriter writes a transcript people can read, one line per message
+type textExportWriter struct {
+	w io.Writer
+}
+
+func (e *textExportWriter) begin(room models.Room) error {
+	_, err := fmt.Fprintf(e.w, "Transcript of %s\n\n", room.Name)
+	return err
+}
+
+func (e *textExportWriter) write(message models.Message) error {
+	username := "unknown user"
+	if message.User != nil {
+		username = message.User.Username
+	}
+
+	reply := ""
+	if message.ParentID != nil {
+		reply = fmt.Sprintf(" (reply to #%d)", *message.ParentID)
+	}
+
+	edited := ""
+	if message.EditedAt != nil {
+		edited = " (edited)"
+	}
+
+	// Lines after the first of a message are indented, so every message starts on a line of its own
+	text := strings.ReplaceAll(message.Text, "\n", "\n    ")
+	_, err := fmt.Fprintf(e.w, "#%d [%s] %s%s: %s%s\n", message.ID,
+		message.CreatedAt.UTC().Format("2006-01-02 15:04:05"), username, reply, text, edited)
+	if err != nil {
+		return err
+	}
+
+	for _, attachment := range message.Attachments {
+		_, err = fmt.Fprintf(e.w, "    [file] %s\n", describeAttachment(attachment))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (e *textExportWriter) end() error {
+	return nil
+}
+
+// ExportRoom writes a room's messages to w, oldest first, along with their authors' usernames
+// and the files shared in them. Deleted messages are left out
+func ExportRoom(db *gorm.DB, w io.Writer, room models.Room, options ExportOptions) error {
+	var writer exportWriter
+	switch options.Format {
+	case ExportJSON:
+		writer = &jsonExportWriter{w: w}
+	case ExportCSV:
+		writer = &csvExportWriter{w: csv.NewWriter(w)}
+	case ExportText:
+		writer = &textExportWriter{w: w}
+	default:
+		return fmt.Errorf("%s is not an export format", options.Format)
+	}
+
+	err := writer.begin(room)
+	if err != nil {
+		return err
+	}
+
+	tx := db.Where("room_id = ?", room.ID)
+	if options.From != nil {
+		tx = tx.Where("created_at >= ?", *options.From)
+	}
+	if options.To != nil {
+		tx = tx.Where("created_at <= ?", *options.To)
+	}
+
+	var messages []models.Message
+	tx = tx.Preload("User").Preload("Attachments").FindInBatches(&messages, exportBatchSize, func(_ *gorm.DB, _ int) error {
+		for _, message := range messages {
+			err := writer.write(message)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	return writer.end()
+}
+
+// ExportRoomHistory is a handler that streams a room's history as a file. Site admins can
+// export any room, everyone else the rooms they can read
+func (s *Server) ExportRoomHistory(w http.ResponseWriter, r *http.Request) {
+	logger := s.logger.WithField("method", "ExportRoomHistory")
+
+	query := r.URL.Query()
+	options, err := ParseExportOptions(query.Get("format"), query.Get("from"), query.Get("to"))
+	if err != nil {
+		logger.Errorf("export options are not valid: %s", err.Error())
+		utils.WriteErrorResponse(w, http.StatusBadRequest, err)
+		return
+	}
+
+	roomID, err := strconv.ParseUint(mux.Vars(r)["roomId"], 10, 32)
+	if err != nil {
+		logger.Errorf("room ID is not valid: %s", err.Error())
+		utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("you can only export a valid room ID"))
+		return
+	}
+
+	var room models.Room
+	userID, _ := userFromContext(r.Context())
+	if s.isSiteAdmin(userID) {
+		err = s.chatroomDB.DB.First(&room, roomID).Error
+		if err != nil {
+			utils.WriteErrorResponse(w, http.StatusNotFound, errors.New("no room found with that ID"))
+			return
+		}
+	} else {
+		room, err = s.findAccessibleRoom(userID, uint(roomID))
+		if err != nil {
+			writeStatusError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", exportContentTypes[options.Format])
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", ExportFilename(room, options.Format)))
+	w.WriteHeader(http.StatusOK)
+
+	// The status was already sent, so a failure part way through can only cut the file short
+	err = ExportRoom(s.chatroomDB.DB, w, room, options)
+	if err != nil {
+		logger.Errorf("could not export room %d: %s", room.ID, err.Error())
+	}
+}
@@ -0,0 +1,214 @@
+package service_test
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/msanatan/go-chatroom/app/models"
+	"github.com/msanatan/go-chatroom/app/service"
+)
+
+func Test_ExportRoomHistoryRejectsBadQueries(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+	}{
+		{
+			name: "testing unknown format",
+			path: "/rooms/1/export?format=pdf",
+		},
+		{
+			name: "testing invalid date",
+			path: "/rooms/1/export?from=last-week",
+		},
+		{
+			name: "testing dates out of order",
+			path: "/rooms/1/export?format=csv&from=2021-03-14&to=2021-03-01",
+		},
+		{
+			name: "testing invalid room",
+			path: "/rooms/general/export?format=txt",
+		},
+	}
+
+	wsServer := service.NewServer(nil, nil, nil, "", "/", testLogger)
+	r := mux.NewRouter()
+	r.HandleFunc("/rooms/{roomId}/export", wsServer.ExportRoomHistory)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			r.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if recorder.Code != http.StatusBadRequest {
+				t.Errorf("wrong status code. expected %d but received %d", http.StatusBadRequest, recorder.Code)
+			}
+		})
+	}
+}
+
+func Test_ExportRoomHistoryFormats(t *testing.T) {
+	chatroomDB := testDB(t)
+	wsServer := service.NewServer(nil, chatroomDB, nil, "", "/", testLogger)
+	go wsServer.Run()
+	r := newTestRouter(wsServer)
+
+	alice := createTestUser(t, chatroomDB, "alice")
+	bob := createTestUser(t, chatroomDB, "bob")
+	general := createTestRoom(t, alice, r, "General", models.RoomPublic)
+
+	hello := postTestMessage(t, alice, r, general.ID, "Hello")
+	multiline := postTestMessage(t, alice, r, general.ID, "line one\nline two")
+	var reply service.MessagePayload
+	serveJSON(t, bob, r, http.MethodPost, "/messages",
+		service.MessagePayload{Message: "Hi back", Type: "user", RoomID: general.ID, ParentID: hello.ID},
+		http.StatusCreated, &reply)
+
+	// Deleted messages aren't exported
+	oops := postTestMessage(t, alice, r, general.ID, "oops")
+	recorder := serveAs(alice, r, http.MethodDelete, fmt.Sprintf("/messages/%d", oops.ID), nil)
+	if recorder.Code != http.StatusNoContent {
+		t.Fatalf("could not delete message %d: %s", oops.ID, recorder.Body.String())
+	}
+
+	export := func(query string) string {
+		recorder := serveAs(bob, r, http.MethodGet, fmt.Sprintf("/rooms/%d/export%s", general.ID, query), nil)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("could not export %s: %s", query, recorder.Body.String())
+		}
+
+		return recorder.Body.String()
+	}
+
+	var document struct {
+		Room     service.RoomPayload      `json:"room"`
+		Messages []service.MessagePayload `json:"messages"`
+	}
+	err := json.Unmarshal([]byte(export("")), &document)
+	if err != nil {
+		t.Fatalf("JSON export is not valid: %s", err.Error())
+	}
+
+	if document.Room.Name != "General" || len(document.Messages) != 3 {
+		t.Fatalf("was expecting General's 3 messages but received %+v", document)
+	}
+
+	if document.Messages[0].ID != hello.ID || document.Messages[2].ParentID != hello.ID || document.Messages[2].Username != "bob" {
+		t.Errorf("was expecting the messages oldest first, with bob's reply last, but received %+v", document.Messages)
+	}
+
+	rows, err := csv.NewReader(strings.NewReader(export("?format=csv"))).ReadAll()
+	if err != nil {
+		t.Fatalf("CSV export is not valid: %s", err.Error())
+	}
+
+	if len(rows) != 4 || rows[0][0] != "id" {
+		t.Fatalf("was expecting a header and 3 rows but received %v", rows)
+	}
+
+	if rows[2][7] != "line one\nline two" || rows[3][5] != strconv.FormatUint(uint64(hello.ID), 10) {
+		t.Errorf("was expecting the text and parent of each message to be kept but received %v", rows[1:])
+	}
+
+	transcript := export("?format=txt")
+	if !strings.HasPrefix(transcript, "Transcript of General\n\n") {
+		t.Errorf("was expecting the transcript to start with the room's name but received %q", transcript)
+	}
+
+	for _, line := range []string{
+		fmt.Sprintf("#%d [", multiline.ID),
+		"] alice: line one\n    line two\n",
+		fmt.Sprintf("] bob (reply to #%d): Hi back\n", hello.ID),
+	} {
+		if !strings.Contains(transcript, line) {
+			t.Errorf("was expecting the transcript to have %q but received %q", line, transcript)
+		}
+	}
+
+	if strings.Contains(transcript, "oops") {
+		t.Errorf("was expecting the deleted message to be left out but received %q", transcript)
+	}
+
+	err = json.Unmarshal([]byte(export("?to=2000-01-01")), &document)
+	if err != nil || len(document.Messages) != 0 {
+		t.Errorf("was expecting nothing to be exported before 2000 but received %+v", document.Messages)
+	}
+}
+
+func Test_ExportRoomHistoryNamesTheFile(t *testing.T) {
+	chatroomDB := testDB(t)
+	wsServer := service.NewServer(nil, chatroomDB, nil, "", "/", testLogger)
+	r := newTestRouter(wsServer)
+
+	alice := createTestUser(t, chatroomDB, "alice")
+	room := createTestRoom(t, alice, r, "Release Planning", models.RoomPublic)
+
+	recorder := serveAs(alice, r, http.MethodGet, fmt.Sprintf("/rooms/%d/export?format=csv", room.ID), nil)
+	if disposition := recorder.Header().Get("Content-Disposition"); disposition != `attachment; filename="release-planning.csv"` {
+		t.Errorf("was expecting the export to be named after the room but received %q", disposition)
+	}
+
+	if contentType := recorder.Header().Get("Content-Type"); contentType != "text/csv; charset=utf-8" {
+		t.Errorf("wrong content type, received %q", contentType)
+	}
+}
+
+func Test_ExportRoomHistoryListsAttachments(t *testing.T) {
+	chatroomDB := testDB(t)
+	wsServer := service.NewServer(nil, chatroomDB, newMemoryStorage(), "", "/", testLogger)
+	go wsServer.Run()
+	r := newTestRouter(wsServer)
+
+	alice := createTestUser(t, chatroomDB, "alice")
+	room := createTestRoom(t, alice, r, "Design", models.RoomPublic)
+
+	recorder := uploadAs(alice, r, room.ID, "mockup.png", testPNG, map[string]string{"message": "New mockup"})
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("could not upload file: %s", recorder.Body.String())
+	}
+
+	var message service.MessagePayload
+	json.Unmarshal(recorder.Body.Bytes(), &message)
+	attachment := message.Attachments[0]
+	description := fmt.Sprintf("mockup.png (image/png, %d bytes) %s", len(testPNG), attachment.URL)
+
+	export := func(format string) string {
+		recorder := serveAs(alice, r, http.MethodGet, fmt.Sprintf("/rooms/%d/export?format=%s", room.ID, format), nil)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("could not export %s: %s", format, recorder.Body.String())
+		}
+
+		return recorder.Body.String()
+	}
+
+	var document struct {
+		Messages []service.MessagePayload `json:"messages"`
+	}
+	err := json.Unmarshal([]byte(export("json")), &document)
+	if err != nil || len(document.Messages) != 1 || len(document.Messages[0].Attachments) != 1 {
+		t.Fatalf("was expecting the JSON export to have the file but received %+v", document.Messages)
+	}
+
+	if exported := document.Messages[0].Attachments[0]; exported != attachment {
+		t.Errorf("was expecting the JSON export to have %+v but received %+v", attachment, exported)
+	}
+
+	rows, err := csv.NewReader(strings.NewReader(export("csv"))).ReadAll()
+	if err != nil || len(rows) != 2 {
+		t.Fatalf("was expecting a header and 1 row but received %v: %v", rows, err)
+	}
+
+	if rows[0][8] != "attachments" || rows[1][8] != description {
+		t.Errorf("was expecting the CSV export to have %q but received %v", description, rows)
+	}
+
+	if transcript := export("txt"); !strings.Contains(transcript, ": New mockup\n    [file] "+description+"\n") {
+		t.Errorf("was expecting the transcript to list the file under its message but received %q", transcript)
+	}
+}
@@ -13,10 +13,11 @@ import (
 	"github.com/msanatan/go-chatroom/app/models"
 	"github.com/msanatan/go-chatroom/rabbitmq"
 	"github.com/msanatan/go-chatroom/utils"
+	"gorm.io/gorm"
 )
 
-// GetLastMessages pulls the latest messages from the DB
-// Typically used before a client connects to populate the chat
+// GetLastMessages pulls a page of messages from the DB, the newest page unless a
+// before or after cursor is given. Typically used before a client connects to populate the chat
 func (s *Server) GetLastMessages(w http.ResponseWriter, r *http.Request) {
 	logger := s.logger.WithField("method", "GetLastMessages")
 
@@ -29,29 +30,55 @@ func (s *Server) GetLastMessages(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var messages []models.Message
-	tx := s.chatroomDB.DB.Where("room_id = ?", roomID).Order("created_at asc").Limit(50).Preload("User").Find(&messages)
-	if tx.Error != nil {
-		logger.Errorf("could not pull latest messages: %s", tx.Error.Error())
+	page, err := parsePageQuery(r.URL.Query())
+	if err != nil {
+		logger.Errorf("page query is not valid: %s", err.Error())
+		utils.WriteErrorResponse(w, http.StatusBadRequest, err)
+		return
+	}
+
+	userID, username := userFromContext(r.Context())
+	room, err := s.findAccessibleRoom(userID, uint(roomID))
+	if err != nil {
+		writeStatusError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	// Replies are only shown in their threads
+	messages, nextCursor, prevCursor, err := findMessagesPage(s.chatroomDB.DB.Where("room_id = ? AND parent_id IS NULL", roomID), page)
+	if err != nil {
+		logger.Errorf("could not pull latest messages: %s", err.Error())
 		utils.WriteErrorResponse(w, http.StatusBadRequest,
 			errors.New("could not pull the most recent messages from this chat"))
 		return
 	}
 
-	var messagesPayload []MessagePayload
+	messagesPayload := []MessagePayload{}
 	for _, message := range messages {
-		messagesPayload = append(messagesPayload, MessagePayload{
-			Message:  message.Text,
-			Type:     message.Type,
-			Username: message.User.Username,
-			RoomID:   message.RoomID,
-			Created:  message.CreatedAt.Format(time.RFC1123Z),
-		})
+		messagesPayload = append(messagesPayload, newMessagePayload(message))
+	}
+
+	err = s.attachReactions(messagesPayload)
+	if err != nil {
+		// The messages are still worth returning without their reactions
+		logger.Errorf("could not pull reactions: %s", err.Error())
+	}
+
+	err = s.attachThreadSummaries(messagesPayload)
+	if err != nil {
+		logger.Errorf("could not pull thread summaries: %s", err.Error())
+	}
+
+	// Loading the newest page means the user has caught up with the room
+	if page.before == 0 && page.after == 0 {
+		s.markRead(userID, username, room.ID, room.LastSeq, nil)
 	}
 
 	responsePayload := MessagesPayload{
-		Messages: messagesPayload,
-		Size:     len(messagesPayload),
+		Messages:   messagesPayload,
+		Size:       len(messagesPayload),
+		NextCursor: nextCursor,
+		PrevCursor: prevCursor,
 	}
 
 	resp, _ := json.Marshal(&responsePayload)
@@ -60,52 +87,127 @@ func (s *Server) GetLastMessages(w http.ResponseWriter, r *http.Request) {
 	w.Write(resp)
 }
 
-// CreateMessage adds a new message to the DB and websocket server
-// It also publishes to RabbitMQ in case it's a bot
-func (s *Server) CreateMessage(w http.ResponseWriter, r *http.Request) {
-	logger := s.logger.WithField("method", "CreateMessage")
+// newMessagePayload converts a stored message, with its user preloaded, to its API form
+func newMessagePayload(message models.Message) MessagePayload {
+	payload := MessagePayload{
+		ID:      message.ID,
+		Seq:     message.Seq,
+		Message: message.Text,
+		Type:    message.Type,
+		RoomID:  message.RoomID,
+		Created: message.CreatedAt.Format(time.RFC1123Z),
+	}
 
-	var newMessage MessagePayload
-	err := json.NewDecoder(r.Body).Decode(&newMessage)
-	if err != nil {
-		logger.Errorf("could not unmarshal request body: %s", err.Error())
-		utils.WriteErrorResponse(w, http.StatusBadRequest, err)
-		return
+	if message.ParentID != nil {
+		payload.ParentID = *message.ParentID
+	}
+
+	if message.User != nil {
+		payload.Username = message.User.Username
+	}
+
+	if message.EditedAt != nil {
+		payload.Edited = message.EditedAt.Format(time.RFC1123Z)
+	}
+
+	for _, attachment := range message.Attachments {
+		payload.Attachments = append(payload.Attachments, newAttachmentPayload(attachment))
 	}
 
+	return payload
+}
+
+// persistMessage validates and stores a message sent by a user, along with the files
+// attached to it, broadcasting it to the room and forwarding it to the bots if it's a
+// command. It's shared by the HTTP and WS APIs
+func (s *Server) persistMessage(userID uint, username string, newMessage MessagePayload,
+	attachments []models.Attachment) (MessagePayload, error) {
+	logger := s.logger.WithField("method", "persistMessage")
+
 	var message models.Message
 	message.Text = newMessage.Message
 	message.Type = newMessage.Type
-	userIDFromContext := r.Context().Value("userId").(int)
-	message.UserID = uint(userIDFromContext)
+	message.UserID = userID
 	message.RoomID = newMessage.RoomID
 	message.Init()
 
-	err = message.Validate()
+	err := message.Validate()
 	if err != nil {
 		logger.Errorf("message is not valid: %s", err.Error())
-		utils.WriteErrorResponse(w, http.StatusBadRequest, err)
-		return
+		return MessagePayload{}, err
 	}
 
-	tx := s.chatroomDB.DB.Create(&message)
-	if tx.Error != nil {
-		logger.Errorf("failed to create message: %s", tx.Error.Error())
-		utils.WriteErrorResponse(w, http.StatusBadRequest,
-			errors.New("could not create a message at this time, please review your request and try again"))
-		return
+	room, err := s.findWritableRoom(userID, message.RoomID)
+	if err != nil {
+		return MessagePayload{}, err
+	}
+
+	var parent models.Message
+	if newMessage.ParentID != 0 {
+		parent, err = s.findThreadParent(newMessage.ParentID, message.RoomID)
+		if err != nil {
+			return MessagePayload{}, err
+		}
+		message.ParentID = &parent.ID
+	}
+
+	err = s.chatroomDB.DB.Transaction(func(tx *gorm.DB) error {
+		// Bumping the room's counter locks its row, so messages sent at the same
+		// time still get their own sequence numbers
+		err := tx.Raw("UPDATE rooms SET last_seq = last_seq + 1, last_message_at = ? WHERE id = ? AND deleted_at IS NULL RETURNING last_seq",
+			message.CreatedAt, message.RoomID).Scan(&message.Seq).Error
+		if err != nil {
+			return err
+		}
+
+		if message.Seq == 0 {
+			return gorm.ErrRecordNotFound
+		}
+
+		err = tx.Create(&message).Error
+		if err != nil {
+			return err
+		}
+
+		for i := range attachments {
+			attachments[i].MessageID = message.ID
+			err = tx.Create(&attachments[i]).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		logger.Errorf("failed to create message: %s", err.Error())
+		return MessagePayload{}, errors.New("could not create a message at this time, please review your request and try again")
 	}
 
 	responsePayload := MessagePayload{
+		ID:       message.ID,
+		Seq:      message.Seq,
 		Message:  message.Text,
 		Type:     message.Type,
-		Username: r.Context().Value("username").(string),
+		Username: username,
 		RoomID:   message.RoomID,
+		ParentID: newMessage.ParentID,
 		Created:  message.CreatedAt.Format(time.RFC1123Z),
 	}
 
-	// Now that message is in DB, let's write it to the websocket server
-	s.broadcast <- responsePayload
+	for _, attachment := range attachments {
+		responsePayload.Attachments = append(responsePayload.Attachments, newAttachmentPayload(attachment))
+	}
+
+	// Now that message is in DB, let's write it to the websocket server.
+	// Replies go to the people in the thread rather than the whole room
+	if message.ParentID != nil {
+		s.broadcastReply(parent, responsePayload)
+	} else {
+		s.broadcast <- NewEnvelope(KindMessage, responsePayload.RoomID, responsePayload)
+	}
+
+	s.notifyMentions(message, room, responsePayload)
 
 	// Check if message should be handled by a bot
 	if s.IsValidBotCommand(responsePayload.Message) {
@@ -120,40 +222,201 @@ func (s *Server) CreateMessage(w http.ResponseWriter, r *http.Request) {
 			botPayloadJSON, err := json.Marshal(botPayload)
 			if err != nil {
 				logger.Errorf("strangely enough, could not convert the bot error response to JSON: %s", err.Error())
-				s.broadcast <- MessagePayload{
+				s.broadcast <- NewEnvelope(KindMessage, message.RoomID, MessagePayload{
 					Message: "Could not send a valid request to the bot. Please review your command",
 					RoomID:  message.RoomID,
 					Type:    "error",
-				}
+				})
+			} else {
+				s.rabbitMQClient.Publish(botPayloadJSON)
 			}
-
-			s.rabbitMQClient.Publish(botPayloadJSON)
 		} else {
-			s.broadcast <- MessagePayload{
+			s.broadcast <- NewEnvelope(KindMessage, message.RoomID, MessagePayload{
 				Message: "This chatroom isn't configured to work with bots",
 				RoomID:  message.RoomID,
 				Type:    "error",
-			}
+			})
 		}
 	}
 
+	return responsePayload, nil
+}
+
+// CreateMessage adds a new message to the DB and websocket server
+// It also publishes to RabbitMQ in case it's a bot
+func (s *Server) CreateMessage(w http.ResponseWriter, r *http.Request) {
+	logger := s.logger.WithField("method", "CreateMessage")
+
+	var newMessage MessagePayload
+	err := json.NewDecoder(r.Body).Decode(&newMessage)
+	if err != nil {
+		logger.Errorf("could not unmarshal request body: %s", err.Error())
+		utils.WriteErrorResponse(w, http.StatusBadRequest, err)
+		return
+	}
+
+	userID, username := userFromContext(r.Context())
+	responsePayload, err := s.persistMessage(userID, username, newMessage, nil)
+	if err != nil {
+		writeStatusError(w, http.StatusBadRequest, err)
+		return
+	}
+
 	resp, _ := json.Marshal(&responsePayload)
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	w.Write(resp)
 }
 
+// EditMessage changes the text of a message, keeping the previous text in the
+// edit history. Only the message's author can edit it
+func (s *Server) EditMessage(w http.ResponseWriter, r *http.Request) {
+	logger := s.logger.WithField("method", "EditMessage")
+
+	message, ok := s.findAuthoredMessage(w, r, false)
+	if !ok {
+		return
+	}
+
+	var editRequest MessagePayload
+	err := json.NewDecoder(r.Body).Decode(&editRequest)
+	if err != nil {
+		logger.Errorf("could not unmarshal request body: %s", err.Error())
+		utils.WriteErrorResponse(w, http.StatusBadRequest, err)
+		return
+	}
+
+	userID, _ := userFromContext(r.Context())
+	edit, err := message.Edit(editRequest.Message, userID)
+	if err != nil {
+		logger.Errorf("edit is not valid: %s", err.Error())
+		utils.WriteErrorResponse(w, http.StatusBadRequest, err)
+		return
+	}
+
+	err = s.chatroomDB.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Create(edit).Error
+		if err != nil {
+			return err
+		}
+
+		return tx.Model(&message).Updates(map[string]interface{}{
+			"text":      message.Text,
+			"edited_at": message.EditedAt,
+		}).Error
+	})
+	if err != nil {
+		logger.Errorf("failed to edit message: %s", err.Error())
+		utils.WriteErrorResponse(w, http.StatusBadRequest,
+			errors.New("could not edit the message at this time, please try again"))
+		return
+	}
+
+	responsePayload := newMessagePayload(message)
+	s.broadcastMessageEvent(message, NewEnvelope(KindMessageEdited, message.RoomID, responsePayload))
+
+	resp, _ := json.Marshal(&responsePayload)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(resp)
+}
+
+// DeleteMessage removes a message from its room. Only the message's author
+// and the room's moderators can delete it
+func (s *Server) DeleteMessage(w http.ResponseWriter, r *http.Request) {
+	logger := s.logger.WithField("method", "DeleteMessage")
+
+	message, ok := s.findAuthoredMessage(w, r, true)
+	if !ok {
+		return
+	}
+
+	tx := s.chatroomDB.DB.Delete(&message)
+	if tx.Error != nil {
+		logger.Errorf("failed to delete message: %s", tx.Error.Error())
+		utils.WriteErrorResponse(w, http.StatusBadRequest,
+			errors.New("could not delete the message at this time, please try again"))
+		return
+	}
+
+	// Deleted messages don't keep their place among the room's pins
+	tx = s.chatroomDB.DB.Where("message_id = ?", message.ID).Delete(&models.Pin{})
+	if tx.Error != nil {
+		logger.Errorf("failed to unpin deleted message: %s", tx.Error.Error())
+	}
+
+	s.broadcastMessageEvent(message, NewEnvelope(KindMessageDeleted, message.RoomID, MessageDeletedEvent{
+		ID:     message.ID,
+		RoomID: message.RoomID,
+	}))
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// findAuthoredMessage loads the message in the URL, making sure the requester wrote it,
+// or moderates its room when moderators are allowed to change it.
+// When it returns false an error response was already written
+func (s *Server) findAuthoredMessage(w http.ResponseWriter, r *http.Request, moderated bool) (models.Message, bool) {
+	logger := s.logger.WithField("method", "findAuthoredMessage")
+	var message models.Message
+
+	vars := mux.Vars(r)
+	messageID, err := strconv.ParseUint(vars["id"], 10, 32)
+	if err != nil {
+		logger.Errorf("message ID is not valid: %s", err.Error())
+		utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("message ID is not valid"))
+		return message, false
+	}
+
+	tx := s.chatroomDB.DB.Preload("User").Preload("Attachments").First(&message, messageID)
+	if tx.Error != nil {
+		logger.Errorf("could not find message: %s", tx.Error.Error())
+		utils.WriteErrorResponse(w, http.StatusNotFound, errors.New("no message found with that ID"))
+		return message, false
+	}
+
+	userID, _ := userFromContext(r.Context())
+	_, err = s.findWritableRoom(userID, message.RoomID)
+	if err != nil {
+		writeStatusError(w, http.StatusForbidden, err)
+		return message, false
+	}
+
+	if message.UserID != userID && moderated {
+		_, membership, err := s.findRoomMembership(userID, message.RoomID)
+		if err == nil && membership.CanModerate() {
+			return message, true
+		}
+	}
+
+	if message.UserID != userID {
+		logger.Errorf("user %d tried to change message %d from user %d", userID, message.ID, message.UserID)
+		utils.WriteErrorResponse(w, http.StatusForbidden, errors.New("you can only change your own messages"))
+		return message, false
+	}
+
+	return message, true
+}
+
 // CreateRoom is a handler that creates a new room
 func (s *Server) CreateRoom(w http.ResponseWriter, r *http.Request) {
 	logger := s.logger.WithField("method", "CreateRoom")
-	var room models.Room
-	err := json.NewDecoder(r.Body).Decode(&room)
+	var request RoomRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
 	if err != nil {
 		logger.Errorf("could not unmarshal request body: %s", err.Error())
 		utils.WriteErrorResponse(w, http.StatusBadRequest, err)
 		return
 	}
 
+	// Direct conversations are started through their own endpoint
+	room := models.Room{
+		Name:        request.Name,
+		Kind:        models.RoomKindChannel,
+		Visibility:  request.Visibility,
+		Topic:       request.Topic,
+		Description: request.Description,
+	}
 	room.Init()
 	err = room.Validate()
 	if err != nil {
@@ -162,18 +425,31 @@ func (s *Server) CreateRoom(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	createdRoom := s.chatroomDB.DB.Create(&room)
-	if createdRoom.Error != nil {
-		logger.Errorf("failed to create room: %s", createdRoom.Error.Error())
+	taken, err := s.slugTaken(room.Slug, 0)
+	if err == nil && taken {
+		utils.WriteErrorResponse(w, http.StatusConflict, errors.New("there's already a room called "+room.Name))
+		return
+	}
+
+	// The creator is a member so they can still get into the room if it's private
+	userID, _ := userFromContext(r.Context())
+	err = s.createRoomWithOwner(&room, userID)
+	if err != nil {
+		logger.Errorf("failed to create room: %s", err.Error())
+		// Someone may have taken the name while the room was being created
+		taken, _ := s.slugTaken(room.Slug, 0)
+		if taken {
+			utils.WriteErrorResponse(w, http.StatusConflict, errors.New("there's already a room called "+room.Name))
+			return
+		}
+
 		utils.WriteErrorResponse(w, http.StatusBadRequest,
 			errors.New("could not create a room at this time, please review your details and try again"))
 		return
 	}
 
-	responsePayload := RoomPayload{
-		ID:   room.ID,
-		Name: room.Name,
-	}
+	responsePayload := newRoomPayload(room)
+	responsePayload.Role = models.RoleOwner
 
 	resp, _ := json.Marshal(&responsePayload)
 	w.Header().Set("Content-Type", "application/json")
@@ -181,30 +457,248 @@ func (s *Server) CreateRoom(w http.ResponseWriter, r *http.Request) {
 	w.Write(resp)
 }
 
-// GetRooms returns a list of all rooms
+// GetRoom is a handler that returns a room's details
+func (s *Server) GetRoom(w http.ResponseWriter, r *http.Request) {
+	logger := s.logger.WithField("method", "GetRoom")
+
+	room, membership, ok := s.roomFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	roomsPayload := []RoomPayload{newRoomPayload(room)}
+	err := s.attachMembers(roomsPayload)
+	if err != nil {
+		logger.Errorf("could not list conversation members: %s", err.Error())
+	}
+
+	responsePayload := roomsPayload[0]
+	responsePayload.Role = membership.Role
+
+	resp, _ := json.Marshal(&responsePayload)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(resp)
+}
+
+// GetRoomByName is a handler that returns the details of the channel with the slug in the URL
+func (s *Server) GetRoomByName(w http.ResponseWriter, r *http.Request) {
+	logger := s.logger.WithField("method", "GetRoomByName")
+
+	room, err := s.findRoomBySlug(mux.Vars(r)["slug"])
+	if err != nil {
+		writeStatusError(w, http.StatusNotFound, err)
+		return
+	}
+
+	userID, _ := userFromContext(r.Context())
+	room, membership, err := s.findRoomMembership(userID, room.ID)
+	if err != nil {
+		logger.Errorf("could not open room %d: %s", room.ID, err.Error())
+		writeStatusError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	responsePayload := newRoomPayload(room)
+	responsePayload.Role = membership.Role
+
+	resp, _ := json.Marshal(&responsePayload)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(resp)
+}
+
+// UpdateRoom is a handler that changes a room's name, topic or description.
+// Only moderators can change them, and archived rooms can't be changed at all
+func (s *Server) UpdateRoom(w http.ResponseWriter, r *http.Request) {
+	logger := s.logger.WithField("method", "UpdateRoom")
+
+	room, membership, ok := s.roomFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if !membership.CanModerate() {
+		utils.WriteErrorResponse(w, http.StatusForbidden, errors.New("only moderators can change this room"))
+		return
+	}
+
+	if room.IsArchived() {
+		utils.WriteErrorResponse(w, http.StatusForbidden, errors.New("this room is archived"))
+		return
+	}
+
+	var request RoomUpdateRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		logger.Errorf("could not unmarshal request body: %s", err.Error())
+		utils.WriteErrorResponse(w, http.StatusBadRequest, err)
+		return
+	}
+
+	renamed := request.Name != nil && *request.Name != room.Name
+	if renamed {
+		room.Rename(*request.Name)
+	}
+
+	topicChanged := request.Topic != nil && *request.Topic != room.Topic
+	if topicChanged {
+		room.Topic = *request.Topic
+	}
+
+	if request.Description != nil {
+		room.Description = *request.Description
+	}
+
+	err = room.Validate()
+	if err != nil {
+		logger.Errorf("room is not valid: %s", err.Error())
+		utils.WriteErrorResponse(w, http.StatusBadRequest, err)
+		return
+	}
+
+	taken, err := s.slugTaken(room.Slug, room.ID)
+	if err == nil && taken {
+		utils.WriteErrorResponse(w, http.StatusConflict, errors.New("there's already a room called "+room.Name))
+		return
+	}
+
+	tx := s.chatroomDB.DB.Model(&room).Updates(map[string]interface{}{
+		"name":        room.Name,
+		"slug":        room.Slug,
+		"topic":       room.Topic,
+		"description": room.Description,
+	})
+	if tx.Error != nil {
+		logger.Errorf("failed to update room: %s", tx.Error.Error())
+		utils.WriteErrorResponse(w, http.StatusBadRequest,
+			errors.New("could not update the room at this time, please try again"))
+		return
+	}
+
+	if renamed {
+		s.broadcast <- NewEnvelope(KindSystem, room.ID, SystemPayload{
+			Event:   SystemRoomRenamed,
+			Message: room.Name,
+		})
+	}
+
+	if topicChanged {
+		s.broadcast <- NewEnvelope(KindSystem, room.ID, SystemPayload{
+			Event:   SystemTopicChanged,
+			Message: room.Topic,
+		})
+	}
+
+	responsePayload := newRoomPayload(room)
+	responsePayload.Role = membership.Role
+
+	resp, _ := json.Marshal(&responsePayload)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(resp)
+}
+
+// ArchiveRoom is a handler that makes a room read-only, keeping its history.
+// Only the room's owner can archive it
+func (s *Server) ArchiveRoom(w http.ResponseWriter, r *http.Request) {
+	s.setArchived(w, r, true)
+}
+
+// UnarchiveRoom is a handler that lets people post in an archived room again
+func (s *Server) UnarchiveRoom(w http.ResponseWriter, r *http.Request) {
+	s.setArchived(w, r, false)
+}
+
+// setArchived archives or unarchives the room in the URL, telling the people in it
+func (s *Server) setArchived(w http.ResponseWriter, r *http.Request, archived bool) {
+	logger := s.logger.WithField("method", "setArchived")
+
+	room, membership, ok := s.roomFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if !membership.IsOwner() {
+		utils.WriteErrorResponse(w, http.StatusForbidden, errors.New("only the room's owner can archive it"))
+		return
+	}
+
+	if room.IsArchived() != archived {
+		event := SystemRoomUnarchived
+		room.ArchivedAt = nil
+		if archived {
+			event = SystemRoomArchived
+			now := time.Now()
+			room.ArchivedAt = &now
+		}
+
+		tx := s.chatroomDB.DB.Model(&room).Update("archived_at", room.ArchivedAt)
+		if tx.Error != nil {
+			logger.Errorf("failed to archive room: %s", tx.Error.Error())
+			utils.WriteErrorResponse(w, http.StatusBadRequest,
+				errors.New("could not archive the room at this time, please try again"))
+			return
+		}
+
+		s.broadcast <- NewEnvelope(KindSystem, room.ID, SystemPayload{Event: event})
+	}
+
+	responsePayload := newRoomPayload(room)
+	responsePayload.Role = membership.Role
+
+	resp, _ := json.Marshal(&responsePayload)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(resp)
+}
+
+// GetRooms returns a page of the room directory: the channels the requester can see,
+// along with the direct conversations they're in. Rooms can be searched by name or
+// topic with q, and sorted by when they were created, name, activity or member count
 func (s *Server) GetRooms(w http.ResponseWriter, r *http.Request) {
 	logger := s.logger.WithField("method", "GetRooms")
 
-	var rooms []models.Room
-	tx := s.chatroomDB.DB.Order("created_at asc").Find(&rooms)
-	if tx.Error != nil {
-		logger.Errorf("could not pull list of rooms: %s", tx.Error.Error())
+	query, err := parseDirectoryQuery(r.URL.Query())
+	if err != nil {
+		logger.Errorf("directory query is not valid: %s", err.Error())
+		utils.WriteErrorResponse(w, http.StatusBadRequest, err)
+		return
+	}
+
+	userID, _ := userFromContext(r.Context())
+	rooms, nextOffset, err := findRoomsPage(visibleRooms(s.chatroomDB.DB, userID), query)
+	if err != nil {
+		logger.Errorf("could not pull list of rooms: %s", err.Error())
 		utils.WriteErrorResponse(w, http.StatusBadRequest,
 			errors.New("could not pull the list of rooms"))
 		return
 	}
 
-	var roomsPayload []RoomPayload
+	roomsPayload := []RoomPayload{}
 	for _, room := range rooms {
-		roomsPayload = append(roomsPayload, RoomPayload{
-			ID:   room.ID,
-			Name: room.Name,
-		})
+		roomsPayload = append(roomsPayload, newRoomPayload(room))
+	}
+
+	err = s.attachMembers(roomsPayload)
+	if err != nil {
+		logger.Errorf("could not list conversation members: %s", err.Error())
+	}
+
+	err = s.attachRoles(roomsPayload, userID)
+	if err != nil {
+		logger.Errorf("could not pull roles: %s", err.Error())
+	}
+
+	err = s.attachActivity(roomsPayload, userID)
+	if err != nil {
+		logger.Errorf("could not pull room activity: %s", err.Error())
 	}
 
 	responsePayload := RoomsPayload{
-		Rooms: roomsPayload,
-		Size:  len(roomsPayload),
+		Rooms:      roomsPayload,
+		Size:       len(roomsPayload),
+		NextOffset: nextOffset,
 	}
 
 	resp, _ := json.Marshal(&responsePayload)
@@ -328,3 +822,10 @@ func (s *Server) IsAuthenticated(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// userFromContext returns the user details IsAuthenticated stored in the request context
+func userFromContext(ctx context.Context) (uint, string) {
+	userID, _ := ctx.Value("userId").(int)
+	username, _ := ctx.Value("username").(string)
+	return uint(userID), username
+}
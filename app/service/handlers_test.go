@@ -0,0 +1,131 @@
+package service_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/msanatan/go-chatroom/app/models"
+	"github.com/msanatan/go-chatroom/app/service"
+)
+
+func Test_GetLastMessagesRejectsBadPages(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+	}{
+		{
+			name:  "testing before and after",
+			query: "?before=10&after=2",
+		},
+		{
+			name:  "testing invalid before",
+			query: "?before=latest",
+		},
+		{
+			name:  "testing zero after",
+			query: "?after=0",
+		},
+		{
+			name:  "testing negative limit",
+			query: "?limit=-5",
+		},
+		{
+			name:  "testing invalid limit",
+			query: "?limit=all",
+		},
+	}
+
+	wsServer := service.NewServer(nil, nil, nil, "", "/", testLogger)
+	r := mux.NewRouter()
+	r.HandleFunc("/rooms/{roomId}/messages", wsServer.GetLastMessages)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			r.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/rooms/1/messages"+tt.query, nil))
+			if recorder.Code != http.StatusBadRequest {
+				t.Errorf("wrong status code. expected %d but received %d", http.StatusBadRequest, recorder.Code)
+			}
+		})
+	}
+}
+
+func Test_GetLastMessagesPagesWithCursors(t *testing.T) {
+	chatroomDB := testDB(t)
+	wsServer := service.NewServer(nil, chatroomDB, nil, "", "/", testLogger)
+	go wsServer.Run()
+	r := newTestRouter(wsServer)
+
+	alice := createTestUser(t, chatroomDB, "alice")
+	room := createTestRoom(t, alice, r, "General", models.RoomPublic)
+
+	var ids []uint
+	for i := 1; i <= 5; i++ {
+		ids = append(ids, postTestMessage(t, alice, r, room.ID, fmt.Sprintf("message %d", i)).ID)
+	}
+
+	tests := []struct {
+		name       string
+		query      string
+		messages   []uint
+		nextCursor uint
+		prevCursor uint
+	}{
+		{
+			name:       "testing the latest page",
+			query:      "?limit=2",
+			messages:   ids[3:5],
+			nextCursor: ids[3],
+		},
+		{
+			name:       "testing before",
+			query:      fmt.Sprintf("?limit=2&before=%d", ids[3]),
+			messages:   ids[1:3],
+			nextCursor: ids[1],
+			prevCursor: ids[2],
+		},
+		{
+			name:       "testing the oldest page",
+			query:      fmt.Sprintf("?limit=2&before=%d", ids[1]),
+			messages:   ids[0:1],
+			prevCursor: ids[0],
+		},
+		{
+			name:       "testing after",
+			query:      fmt.Sprintf("?limit=2&after=%d", ids[0]),
+			messages:   ids[1:3],
+			nextCursor: ids[1],
+			prevCursor: ids[2],
+		},
+		{
+			name:       "testing after up to the latest",
+			query:      fmt.Sprintf("?limit=2&after=%d", ids[2]),
+			messages:   ids[3:5],
+			nextCursor: ids[3],
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var page service.MessagesPayload
+			serveJSON(t, alice, r, http.MethodGet, fmt.Sprintf("/rooms/%d/messages%s", room.ID, tt.query), nil, http.StatusOK, &page)
+
+			var received []uint
+			for _, message := range page.Messages {
+				received = append(received, message.ID)
+			}
+
+			if fmt.Sprint(received) != fmt.Sprint(tt.messages) {
+				t.Errorf("wrong messages. expected %v but received %v", tt.messages, received)
+			}
+
+			if page.NextCursor != tt.nextCursor || page.PrevCursor != tt.prevCursor {
+				t.Errorf("wrong cursors. expected %d and %d but received %d and %d",
+					tt.nextCursor, tt.prevCursor, page.NextCursor, page.PrevCursor)
+			}
+		})
+	}
+}
@@ -0,0 +1,27 @@
+package service
+
+// SendToParticipants queues a message for the given users the way thread replies are sent,
+// so only their connections subscribed to the message's room get it
+func (s *Server) SendToParticipants(userIDs []uint, message Envelope) {
+	s.toUsers <- &usersMessage{
+		userIDs:        userIDs,
+		subscribedOnly: true,
+		message:        message,
+	}
+}
+
+// SendToUsers queues a message for every connection of the given users
+func (s *Server) SendToUsers(userIDs []uint, message Envelope) {
+	s.toUsers <- &usersMessage{
+		userIDs: userIDs,
+		message: message,
+	}
+}
+
+// Evict unsubscribes all of a user's connections from a room, like removing them from it does
+func (s *Server) Evict(userID, roomID uint) {
+	s.evict <- &eviction{
+		userID: userID,
+		roomID: roomID,
+	}
+}
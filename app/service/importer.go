@@ -0,0 +1,474 @@
+package service
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/msanatan/go-chatroom/app/models"
+	"github.com/msanatan/go-chatroom/utils"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// importBatchSize is how many messages are saved per transaction while importing
+const importBatchSize = 500
+
+// importer loads an archive into the DB, remembering what it matched or created along the way
+type importer struct {
+	db     *gorm.DB
+	source string
+	users  map[string]models.User
+	rooms  map[string]models.Room
+	keys   map[string]uint
+	batch  []ArchiveMessage
+	result ImportResult
+}
+
+// ImportArchive loads the rooms, users and messages of a JSON archive, reading its messages
+// as a stream so archives of any size can be imported. Users are matched by username and
+// channels by slug, and are created when they don't exist yet. Messages already imported
+// from the same source are skipped, so importing an archive again only adds what's new.
+// Messages are added after a room's history, so they can't be older than its latest message
+func ImportArchive(db *gorm.DB, r io.Reader) (ImportResult, error) {
+	imp := &importer{
+		db:    db,
+		users: make(map[string]models.User),
+		rooms: make(map[string]models.Room),
+		keys:  make(map[string]uint),
+	}
+
+	decoder := json.NewDecoder(r)
+	err := expectDelim(decoder, '{')
+	if err != nil {
+		return imp.result, err
+	}
+
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return imp.result, err
+		}
+
+		switch token {
+		case "source":
+			err = decoder.Decode(&imp.source)
+		case "users":
+			var users []ArchiveUser
+			err = decoder.Decode(&users)
+			for i := 0; err == nil && i < len(users); i++ {
+				_, err = imp.findOrCreateUser(imp.db, users[i].Username, users[i].Email)
+			}
+		case "rooms":
+			var rooms []ArchiveRoom
+			err = decoder.Decode(&rooms)
+			for i := 0; err == nil && i < len(rooms); i++ {
+				err = imp.importRoom(rooms[i])
+			}
+		case "messages":
+			err = imp.importMessages(decoder)
+		default:
+			var skipped json.RawMessage
+			err = decoder.Decode(&skipped)
+		}
+
+		if err != nil {
+			return imp.result, err
+		}
+	}
+
+	return imp.result, expectDelim(decoder, '}')
+}
+
+// expectDelim reads the next token of a JSON document, failing if it isn't the given delimiter
+func expectDelim(decoder *json.Decoder, delim json.Delim) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+
+	if token != delim {
+		return fmt.Errorf("archive is not valid, expected %s", delim)
+	}
+
+	return nil
+}
+
+// findOrCreateUser matches a username to a user, ignoring case, creating them if they're new.
+// Imported users get a random password, so they can't log in until an admin sets one
+func (imp *importer) findOrCreateUser(tx *gorm.DB, username, email string) (models.User, error) {
+	username = strings.TrimSpace(username)
+	key := strings.ToLower(username)
+	if user, ok := imp.users[key]; ok {
+		return user, nil
+	}
+
+	if username == "" {
+		return models.User{}, errors.New("archive has a user without a username")
+	}
+
+	var user models.User
+	err := tx.Where("LOWER(username) = ?", key).Limit(1).Find(&user).Error
+	if err != nil {
+		return user, err
+	}
+
+	if user.ID == 0 {
+		// Usernames can have characters email addresses can't, so the placeholder uses a hash of it
+		if email == "" {
+			hash := sha256.Sum256([]byte(key))
+			email = "imported-" + hex.EncodeToString(hash[:16]) + "@imported.invalid"
+		}
+
+		password := make([]byte, 32)
+		_, err = rand.Read(password)
+		if err != nil {
+			return user, err
+		}
+
+		hashedPassword, err := models.HashPassword(hex.EncodeToString(password))
+		if err != nil {
+			return user, err
+		}
+
+		user = models.User{Username: username, Email: email, Password: string(hashedPassword)}
+		user.Init()
+		err = user.Validate("create")
+		if err != nil {
+			return user, fmt.Errorf("user %s is not valid: %s", username, err.Error())
+		}
+
+		err = tx.Create(&user).Error
+		if err != nil {
+			return user, fmt.Errorf("could not create user %s: %s", username, err.Error())
+		}
+		imp.result.UsersCreated++
+	}
+
+	imp.users[key] = user
+	return user, nil
+}
+
+// importRoom matches an archived room to a room, creating it if it's new, and makes its members
+// members. The room, its members and any users they need are saved together
+func (imp *importer) importRoom(archived ArchiveRoom) error {
+	if archived.Key == "" {
+		return errors.New("archive has a room without a key")
+	}
+
+	return imp.db.Transaction(func(tx *gorm.DB) error {
+		return imp.saveRoom(tx, archived)
+	})
+}
+
+// saveRoom matches or creates an archived room within a transaction
+func (imp *importer) saveRoom(tx *gorm.DB, archived ArchiveRoom) error {
+	var members []models.User
+	for _, username := range archived.Members {
+		user, err := imp.findOrCreateUser(tx, username, "")
+		if err != nil {
+			return err
+		}
+		members = append(members, user)
+	}
+
+	room := models.Room{
+		Name:        archived.Name,
+		Kind:        archived.Kind,
+		Visibility:  archived.Visibility,
+		Topic:       archived.Topic,
+		Description: archived.Description,
+	}
+	if room.IsDirect() {
+		if len(members) < 2 || len(members) > maxDirectMembers {
+			return fmt.Errorf("direct conversation %s needs between 2 and %d members", archived.Key, maxDirectMembers)
+		}
+
+		var userIDs []uint
+		var usernames []string
+		for _, member := range members {
+			userIDs = append(userIDs, member.ID)
+			usernames = append(usernames, member.Username)
+		}
+		directKey := models.DirectKeyFor(userIDs)
+		room.DirectKey = &directKey
+		room.Name = strings.Join(usernames, ", ")
+	}
+	room.Init()
+
+	query := tx.Session(&gorm.Session{})
+	if room.IsDirect() {
+		query = query.Where("direct_key = ?", *room.DirectKey)
+	} else {
+		query = query.Where("slug = ?", *room.Slug)
+	}
+
+	var existing models.Room
+	err := query.Limit(1).Find(&existing).Error
+	if err != nil {
+		return err
+	}
+
+	if existing.ID != 0 {
+		imp.rooms[archived.Key] = existing
+		return imp.addMembers(tx, existing, members)
+	}
+
+	if archived.Created != nil {
+		room.CreatedAt = *archived.Created
+	}
+
+	err = room.Validate()
+	if err != nil {
+		return fmt.Errorf("room %s is not valid: %s", archived.Key, err.Error())
+	}
+
+	err = tx.Create(&room).Error
+	if err != nil {
+		return fmt.Errorf("could not create room %s: %s", archived.Key, err.Error())
+	}
+	imp.result.RoomsCreated++
+	imp.rooms[archived.Key] = room
+
+	if archived.Owner != "" && !room.IsDirect() {
+		owner, err := imp.findOrCreateUser(tx, archived.Owner, "")
+		if err != nil {
+			return err
+		}
+
+		membership := models.RoomMembership{RoomID: room.ID, UserID: owner.ID, Role: models.RoleOwner}
+		membership.Init()
+		err = tx.Create(&membership).Error
+		if err != nil {
+			return err
+		}
+	}
+
+	return imp.addMembers(tx, room, members)
+}
+
+// addMembers makes users active members of a room, leaving existing memberships as they are
+func (imp *importer) addMembers(tx *gorm.DB, room models.Room, users []models.User) error {
+	for _, user := range users {
+		membership := models.RoomMembership{RoomID: room.ID, UserID: user.ID}
+		membership.Init()
+
+		err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&membership).Error
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// importMessages reads the archive's messages one at a time, saving them in batches
+func (imp *importer) importMessages(decoder *json.Decoder) error {
+	if imp.source == "" {
+		return errors.New("archive needs a source before its messages")
+	}
+
+	err := expectDelim(decoder, '[')
+	if err != nil {
+		return err
+	}
+
+	for decoder.More() {
+		var message ArchiveMessage
+		err = decoder.Decode(&message)
+		if err != nil {
+			return err
+		}
+
+		imp.batch = append(imp.batch, message)
+		if len(imp.batch) == importBatchSize {
+			err = imp.flush()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	err = imp.flush()
+	if err != nil {
+		return err
+	}
+
+	return expectDelim(decoder, ']')
+}
+
+// flush saves the batch of messages read so far in one transaction
+func (imp *importer) flush() error {
+	if len(imp.batch) == 0 {
+		return nil
+	}
+
+	var importKeys []string
+	for _, message := range imp.batch {
+		importKeys = append(importKeys, imp.source+"/"+message.Key)
+	}
+
+	// Messages imported before are skipped, even if they were deleted since
+	var existingKeys []string
+	err := imp.db.Unscoped().Model(&models.Message{}).Where("import_key IN ?", importKeys).
+		Pluck("import_key", &existingKeys).Error
+	if err != nil {
+		return err
+	}
+
+	imported := make(map[string]bool)
+	for _, key := range existingKeys {
+		imported[key] = true
+	}
+
+	err = imp.db.Transaction(func(tx *gorm.DB) error {
+		for i, archived := range imp.batch {
+			if imported[importKeys[i]] {
+				imp.result.MessagesSkipped++
+				continue
+			}
+
+			err := imp.importMessage(tx, archived, importKeys[i])
+			if err != nil {
+				return err
+			}
+			imported[importKeys[i]] = true
+		}
+
+		return nil
+	})
+	imp.batch = imp.batch[:0]
+	return err
+}
+
+// importMessage saves one archived message, numbering it after the room's latest message.
+// Messages older than the room's latest one are rejected, since they would be numbered out of order
+func (imp *importer) importMessage(tx *gorm.DB, archived ArchiveMessage, importKey string) error {
+	if archived.Key == "" {
+		return errors.New("archive has a message without a key")
+	}
+
+	room, ok := imp.rooms[archived.Room]
+	if !ok {
+		return fmt.Errorf("message %s is in room %s, which isn't in the archive's rooms", archived.Key, archived.Room)
+	}
+
+	if archived.Created == nil {
+		return fmt.Errorf("message %s has no created time", archived.Key)
+	}
+
+	user, err := imp.findOrCreateUser(tx, archived.Username, "")
+	if err != nil {
+		return err
+	}
+
+	err = imp.addMembers(tx, room, []models.User{user})
+	if err != nil {
+		return err
+	}
+
+	message := models.Message{
+		Text:      archived.Text,
+		Type:      archived.Type,
+		UserID:    user.ID,
+		RoomID:    room.ID,
+		ImportKey: &importKey,
+		EditedAt:  archived.Edited,
+	}
+	if message.Type == "" {
+		message.Type = "user"
+	}
+	message.CreatedAt = *archived.Created
+	message.UpdatedAt = *archived.Created
+
+	if archived.Parent != "" {
+		parentID, err := imp.findParent(tx, imp.source+"/"+archived.Parent, room.ID)
+		if err != nil {
+			return fmt.Errorf("message %s can't reply to %s: %s", archived.Key, archived.Parent, err.Error())
+		}
+		message.ParentID = &parentID
+	}
+
+	err = message.Validate()
+	if err != nil {
+		return fmt.Errorf("message %s is not valid: %s", archived.Key, err.Error())
+	}
+
+	// Sequence numbers follow the order messages were sent in, so clients catching up
+	// with since never replay imported history as if it were new
+	err = tx.Raw(`UPDATE rooms SET last_seq = last_seq + 1, last_message_at = ?
+		WHERE id = ? AND (last_message_at IS NULL OR last_message_at <= ?) RETURNING last_seq`,
+		message.CreatedAt, room.ID, message.CreatedAt).Scan(&message.Seq).Error
+	if err != nil {
+		return err
+	}
+
+	if message.Seq == 0 {
+		return fmt.Errorf("message %s is older than the latest message in room %s, history can only be added after it",
+			archived.Key, archived.Room)
+	}
+
+	err = tx.Create(&message).Error
+	if err != nil {
+		return fmt.Errorf("could not save message %s: %s", archived.Key, err.Error())
+	}
+
+	if message.ParentID == nil {
+		imp.keys[importKey] = message.ID
+	}
+	imp.result.MessagesImported++
+	return nil
+}
+
+// findParent looks up the imported message a reply belongs to, which must start a thread in the same room
+func (imp *importer) findParent(tx *gorm.DB, importKey string, roomID uint) (uint, error) {
+	if id, ok := imp.keys[importKey]; ok {
+		return id, nil
+	}
+
+	var parent models.Message
+	err := tx.Where("import_key = ? AND room_id = ? AND parent_id IS NULL", importKey, roomID).Limit(1).Find(&parent).Error
+	if err != nil {
+		return 0, err
+	}
+
+	if parent.ID == 0 {
+		return 0, errors.New("the message must come first, in the same room, and not be a reply")
+	}
+
+	imp.keys[importKey] = parent.ID
+	return parent.ID, nil
+}
+
+// ImportHistory is a handler that lets site admins import a JSON archive sent as the request body
+func (s *Server) ImportHistory(w http.ResponseWriter, r *http.Request) {
+	logger := s.logger.WithField("method", "ImportHistory")
+
+	userID, _ := userFromContext(r.Context())
+	if !s.isSiteAdmin(userID) {
+		utils.WriteErrorResponse(w, http.StatusForbidden, errors.New("only site admins can import history"))
+		return
+	}
+
+	started := time.Now()
+	result, err := ImportArchive(s.chatroomDB.DB, r.Body)
+	if err != nil {
+		logger.Errorf("could not import archive: %s", err.Error())
+		utils.WriteErrorResponse(w, http.StatusBadRequest,
+			fmt.Errorf("import stopped, anything before the problem was saved and can be imported again: %s", err.Error()))
+		return
+	}
+	logger.Infof("imported %d messages in %s", result.MessagesImported, time.Since(started))
+
+	resp, _ := json.Marshal(&result)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(resp)
+}
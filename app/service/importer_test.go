@@ -0,0 +1,136 @@
+package service_test
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/badoux/checkmail"
+	"github.com/msanatan/go-chatroom/app/models"
+	"github.com/msanatan/go-chatroom/app/service"
+)
+
+// testArchive has a channel with a thread, and a direct conversation with a user who has no email
+const testArchive = `{
+	"source": "slack",
+	"users": [{"username": "alice", "email": "alice@example.com"}],
+	"rooms": [
+		{"key": "C01", "name": "general", "owner": "alice", "created": "2020-01-06T09:00:00Z"},
+		{"key": "D01", "kind": "direct", "members": ["alice", "Ann Marie"]}
+	],
+	"messages": [
+		{"key": "1", "room": "C01", "username": "alice", "text": "Hello!", "created": "2020-01-06T09:00:00Z"},
+		{"key": "2", "room": "C01", "username": "Ann Marie", "text": "Hi", "parent": "1", "created": "2020-01-06T09:01:00Z"},
+		{"key": "3", "room": "D01", "username": "alice", "text": "Psst", "created": "2020-01-06T09:02:00Z"},
+		{"key": "4", "room": "C01", "username": "alice", "text": "Anyone?", "created": "2020-01-06T09:03:00Z"}%s
+	]
+}`
+
+func Test_ImportArchiveRejectsBadArchives(t *testing.T) {
+	tests := []struct {
+		name    string
+		archive string
+	}{
+		{
+			name:    "testing an array",
+			archive: `[{"source": "slack"}]`,
+		},
+		{
+			name:    "testing invalid JSON",
+			archive: `{"source": "slack",`,
+		},
+		{
+			name:    "testing messages without a source",
+			archive: `{"messages": [{"key": "1", "room": "general", "text": "hi"}]}`,
+		},
+		{
+			name:    "testing messages that aren't a list",
+			archive: `{"source": "slack", "messages": {"key": "1"}}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := service.ImportArchive(nil, strings.NewReader(tt.archive))
+			if err == nil {
+				t.Error("expected the archive to be rejected")
+			}
+		})
+	}
+}
+
+func Test_ImportArchiveSkipsWhatWasImported(t *testing.T) {
+	chatroomDB := testDB(t)
+
+	result, err := service.ImportArchive(chatroomDB.DB, strings.NewReader(strings.Replace(testArchive, "%s", "", 1)))
+	if err != nil {
+		t.Fatalf("could not import archive: %s", err.Error())
+	}
+
+	expected := service.ImportResult{UsersCreated: 2, RoomsCreated: 2, MessagesImported: 4}
+	if result != expected {
+		t.Errorf("was expecting %+v but received %+v", expected, result)
+	}
+
+	var annMarie models.User
+	chatroomDB.DB.Where("username = ?", "Ann Marie").First(&annMarie)
+	if checkmail.ValidateFormat(annMarie.Email) != nil || !strings.HasSuffix(annMarie.Email, "@imported.invalid") {
+		t.Errorf("was expecting Ann Marie to get a valid made up email but received %q", annMarie.Email)
+	}
+
+	// Importing the archive again, now with one more message, only adds that message
+	grown := strings.Replace(testArchive, "%s",
+		`, {"key": "5", "room": "C01", "username": "alice", "text": "Bye", "created": "2020-01-06T09:04:00Z"}`, 1)
+	result, err = service.ImportArchive(chatroomDB.DB, strings.NewReader(grown))
+	if err != nil {
+		t.Fatalf("could not import archive again: %s", err.Error())
+	}
+
+	expected = service.ImportResult{MessagesImported: 1, MessagesSkipped: 4}
+	if result != expected {
+		t.Errorf("was expecting %+v but received %+v", expected, result)
+	}
+
+	var general models.Room
+	chatroomDB.DB.Where("slug = ?", "general").First(&general)
+	var messages []models.Message
+	chatroomDB.DB.Where("room_id = ?", general.ID).Order("seq asc").Find(&messages)
+	if len(messages) != 4 || general.LastSeq != 4 {
+		t.Fatalf("was expecting general to have 4 messages but found %d, last seq %d", len(messages), general.LastSeq)
+	}
+
+	// Sequence numbers and IDs follow the order messages were sent in
+	for i, message := range messages {
+		if message.Seq != uint64(i+1) || (i > 0 && (message.ID < messages[i-1].ID || message.CreatedAt.Before(messages[i-1].CreatedAt))) {
+			t.Errorf("message %d is out of order: seq %d, created %s", message.ID, message.Seq, message.CreatedAt)
+		}
+	}
+
+	if messages[1].ParentID == nil || *messages[1].ParentID != messages[0].ID {
+		t.Errorf("was expecting Ann Marie's message to reply to alice's")
+	}
+}
+
+func Test_ImportArchiveKeepsRoomsInOrder(t *testing.T) {
+	chatroomDB := testDB(t)
+	wsServer := service.NewServer(nil, chatroomDB, nil, "", "/", testLogger)
+	go wsServer.Run()
+	r := newTestRouter(wsServer)
+
+	alice := createTestUser(t, chatroomDB, "alice")
+	general := createTestRoom(t, alice, r, "general", models.RoomPublic)
+	live := postTestMessage(t, alice, r, general.ID, "Already here")
+
+	// The archive's messages are older than the room's, so they'd be numbered out of order
+	_, err := service.ImportArchive(chatroomDB.DB, strings.NewReader(strings.Replace(testArchive, "%s", "", 1)))
+	if err == nil || !strings.Contains(err.Error(), "older than the latest message") {
+		t.Fatalf("was expecting the import to stop at old messages but received %v", err)
+	}
+
+	var page service.MessagesPayload
+	serveJSON(t, alice, r, http.MethodGet, fmt.Sprintf("/rooms/%d/messages", general.ID), nil, http.StatusOK, &page)
+	if page.Size != 1 || page.Messages[0].ID != live.ID {
+		t.Errorf("was expecting the batch with old messages to be rolled back but found %+v", page.Messages)
+	}
+}
@@ -0,0 +1,569 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/msanatan/go-chatroom/app/models"
+	"github.com/msanatan/go-chatroom/utils"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Membership events
+const (
+	MembershipJoined      = "joined"
+	MembershipRemoved     = "removed"
+	MembershipBanned      = "banned"
+	MembershipRoleChanged = "role.changed"
+)
+
+// eviction asks the hub to stop sending a room's events to a user
+type eviction struct {
+	userID uint
+	roomID uint
+}
+
+// evictUser unsubscribes all of a user's connections from a room they no longer belong to
+func (s *Server) evictUser(eviction *eviction) {
+	for client := range s.users[eviction.userID] {
+		client.forgetRoom(eviction.roomID)
+		s.removeSubscription(&Subscription{
+			Client: client,
+			RoomID: eviction.roomID,
+		})
+	}
+}
+
+// roomFromRequest loads the room in the URL and the requester's membership of it, making
+// sure they can use the room. When it returns false an error response was already written
+func (s *Server) roomFromRequest(w http.ResponseWriter, r *http.Request) (models.Room, models.RoomMembership, bool) {
+	logger := s.logger.WithField("method", "roomFromRequest")
+
+	vars := mux.Vars(r)
+	roomID, err := strconv.ParseUint(vars["roomId"], 10, 32)
+	if err != nil {
+		logger.Errorf("room ID is not valid: %s", err.Error())
+		utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("room ID is not valid"))
+		return models.Room{}, models.RoomMembership{}, false
+	}
+
+	userID, _ := userFromContext(r.Context())
+	room, membership, err := s.findRoomMembership(userID, uint(roomID))
+	if err != nil {
+		writeStatusError(w, http.StatusBadRequest, err)
+		return room, membership, false
+	}
+
+	return room, membership, true
+}
+
+// memberFromRequest loads the user in the URL's membership of a room, if they have one.
+// When it returns false an error response was already written
+func (s *Server) memberFromRequest(w http.ResponseWriter, r *http.Request, room models.Room) (models.RoomMembership, bool) {
+	logger := s.logger.WithField("method", "memberFromRequest")
+	var membership models.RoomMembership
+
+	vars := mux.Vars(r)
+	memberID, err := strconv.ParseUint(vars["userId"], 10, 32)
+	if err != nil {
+		logger.Errorf("user ID is not valid: %s", err.Error())
+		utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("user ID is not valid"))
+		return membership, false
+	}
+
+	var user models.User
+	tx := s.chatroomDB.DB.First(&user, memberID)
+	if tx.Error != nil {
+		logger.Errorf("could not find user: %s", tx.Error.Error())
+		utils.WriteErrorResponse(w, http.StatusNotFound, errors.New("no user found with that ID"))
+		return membership, false
+	}
+
+	tx = s.chatroomDB.DB.Where("room_id = ? AND user_id = ?", room.ID, user.ID).Limit(1).Find(&membership)
+	if tx.Error != nil {
+		logger.Errorf("could not find membership: %s", tx.Error.Error())
+		utils.WriteErrorResponse(w, http.StatusBadRequest,
+			errors.New("could not look that user up at this time, please try again"))
+		return membership, false
+	}
+
+	// Users without a membership get an empty status, so nobody mistakes them for a member
+	if tx.RowsAffected == 0 {
+		membership = models.RoomMembership{
+			RoomID: room.ID,
+			UserID: user.ID,
+		}
+	}
+
+	membership.User = &user
+	return membership, true
+}
+
+// findInvitation loads the requester's pending invitation to the room in the URL.
+// When it returns false an error response was already written
+func (s *Server) findInvitation(w http.ResponseWriter, r *http.Request) (models.RoomMembership, bool) {
+	logger := s.logger.WithField("method", "findInvitation")
+	var membership models.RoomMembership
+
+	vars := mux.Vars(r)
+	roomID, err := strconv.ParseUint(vars["roomId"], 10, 32)
+	if err != nil {
+		logger.Errorf("room ID is not valid: %s", err.Error())
+		utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("room ID is not valid"))
+		return membership, false
+	}
+
+	userID, _ := userFromContext(r.Context())
+	tx := s.chatroomDB.DB.Preload("Room").Where("room_id = ? AND user_id = ? AND status = ?",
+		roomID, userID, models.MembershipInvited).First(&membership)
+	if tx.Error != nil {
+		logger.Errorf("could not find invitation: %s", tx.Error.Error())
+		utils.WriteErrorResponse(w, http.StatusNotFound, errors.New("you haven't been invited to this room"))
+		return membership, false
+	}
+
+	return membership, true
+}
+
+// InviteToRoom is a handler that invites a user to a private room the requester is in
+func (s *Server) InviteToRoom(w http.ResponseWriter, r *http.Request) {
+	logger := s.logger.WithField("method", "InviteToRoom")
+
+	room, _, ok := s.roomFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if !room.IsPrivate() || room.IsDirect() {
+		utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("only private rooms take invitations"))
+		return
+	}
+
+	var request InvitationRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		logger.Errorf("could not unmarshal request body: %s", err.Error())
+		utils.WriteErrorResponse(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var invitee models.User
+	tx := s.chatroomDB.DB.Where("username = ?", request.Username).First(&invitee)
+	if tx.Error != nil {
+		logger.Errorf("could not find user: %s", tx.Error.Error())
+		utils.WriteErrorResponse(w, http.StatusNotFound, errors.New("no user found with username: "+request.Username))
+		return
+	}
+
+	userID, username := userFromContext(r.Context())
+	membership := models.RoomMembership{
+		RoomID:    room.ID,
+		UserID:    invitee.ID,
+		Status:    models.MembershipInvited,
+		InvitedBy: &userID,
+	}
+	membership.Init()
+
+	var count int64
+	tx = s.chatroomDB.DB.Model(&models.RoomMembership{}).
+		Where("room_id = ? AND user_id = ?", room.ID, invitee.ID).Count(&count)
+	if tx.Error == nil && count > 0 {
+		utils.WriteErrorResponse(w, http.StatusConflict, errors.New(invitee.Username+" is already in this room, invited to it or banned from it"))
+		return
+	}
+
+	tx = s.chatroomDB.DB.Create(&membership)
+	if tx.Error != nil {
+		logger.Errorf("failed to create invitation: %s", tx.Error.Error())
+		utils.WriteErrorResponse(w, http.StatusBadRequest,
+			errors.New("could not send the invitation at this time, please try again"))
+		return
+	}
+
+	responsePayload := InvitationPayload{
+		Room:      newRoomPayload(room),
+		InvitedBy: username,
+		Created:   membership.CreatedAt.Format(time.RFC1123Z),
+	}
+
+	s.toUsers <- &usersMessage{
+		userIDs: []uint{invitee.ID},
+		message: NewEnvelope(KindInvitation, room.ID, responsePayload),
+	}
+
+	resp, _ := json.Marshal(&responsePayload)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(resp)
+}
+
+// GetInvitations returns the requester's pending invitations
+func (s *Server) GetInvitations(w http.ResponseWriter, r *http.Request) {
+	logger := s.logger.WithField("method", "GetInvitations")
+
+	userID, _ := userFromContext(r.Context())
+	var memberships []models.RoomMembership
+	tx := s.chatroomDB.DB.Preload("Room").Where("user_id = ? AND status = ?", userID, models.MembershipInvited).
+		Order("created_at asc").Find(&memberships)
+	if tx.Error != nil {
+		logger.Errorf("could not pull invitations: %s", tx.Error.Error())
+		utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("could not pull your invitations"))
+		return
+	}
+
+	var inviterIDs []uint
+	for _, membership := range memberships {
+		if membership.InvitedBy != nil {
+			inviterIDs = append(inviterIDs, *membership.InvitedBy)
+		}
+	}
+
+	inviters := make(map[uint]string)
+	if len(inviterIDs) > 0 {
+		var users []models.User
+		tx = s.chatroomDB.DB.Where("id IN ?", inviterIDs).Find(&users)
+		if tx.Error != nil {
+			logger.Errorf("could not pull inviters: %s", tx.Error.Error())
+		}
+
+		for _, user := range users {
+			inviters[user.ID] = user.Username
+		}
+	}
+
+	invitationsPayload := []InvitationPayload{}
+	for _, membership := range memberships {
+		// Invitations to rooms that were since deleted aren't worth showing
+		if membership.Room == nil {
+			continue
+		}
+
+		invitation := InvitationPayload{
+			Room:    newRoomPayload(*membership.Room),
+			Created: membership.CreatedAt.Format(time.RFC1123Z),
+		}
+		if membership.InvitedBy != nil {
+			invitation.InvitedBy = inviters[*membership.InvitedBy]
+		}
+
+		invitationsPayload = append(invitationsPayload, invitation)
+	}
+
+	responsePayload := InvitationsPayload{
+		Invitations: invitationsPayload,
+		Size:        len(invitationsPayload),
+	}
+
+	resp, _ := json.Marshal(&responsePayload)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(resp)
+}
+
+// AcceptInvitation is a handler that makes the requester a member of a room they were invited to
+func (s *Server) AcceptInvitation(w http.ResponseWriter, r *http.Request) {
+	logger := s.logger.WithField("method", "AcceptInvitation")
+
+	membership, ok := s.findInvitation(w, r)
+	if !ok {
+		return
+	}
+
+	tx := s.chatroomDB.DB.Model(&membership).Update("status", models.MembershipActive)
+	if tx.Error != nil {
+		logger.Errorf("failed to accept invitation: %s", tx.Error.Error())
+		utils.WriteErrorResponse(w, http.StatusBadRequest,
+			errors.New("could not accept the invitation at this time, please try again"))
+		return
+	}
+
+	userID, username := userFromContext(r.Context())
+	s.broadcast <- NewEnvelope(KindMembership, membership.RoomID, MembershipEvent{
+		Event:    MembershipJoined,
+		UserID:   userID,
+		Username: username,
+	})
+
+	var responsePayload RoomPayload
+	if membership.Room != nil {
+		responsePayload = newRoomPayload(*membership.Room)
+	}
+
+	resp, _ := json.Marshal(&responsePayload)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(resp)
+}
+
+// DeclineInvitation is a handler that turns down an invitation to a room
+func (s *Server) DeclineInvitation(w http.ResponseWriter, r *http.Request) {
+	logger := s.logger.WithField("method", "DeclineInvitation")
+
+	membership, ok := s.findInvitation(w, r)
+	if !ok {
+		return
+	}
+
+	tx := s.chatroomDB.DB.Delete(&membership)
+	if tx.Error != nil {
+		logger.Errorf("failed to decline invitation: %s", tx.Error.Error())
+		utils.WriteErrorResponse(w, http.StatusBadRequest,
+			errors.New("could not decline the invitation at this time, please try again"))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RemoveMember is a handler that removes a user from a private room, or withdraws their
+// invitation to it. Moderators can remove the members below them, and members can
+// remove themselves to leave a room, unless they own it
+func (s *Server) RemoveMember(w http.ResponseWriter, r *http.Request) {
+	logger := s.logger.WithField("method", "RemoveMember")
+
+	room, requester, ok := s.roomFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if !room.IsPrivate() || room.IsDirect() {
+		utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("only private rooms have members to remove"))
+		return
+	}
+
+	membership, ok := s.memberFromRequest(w, r, room)
+	if !ok {
+		return
+	}
+
+	if !membership.IsActive() && membership.Status != models.MembershipInvited {
+		utils.WriteErrorResponse(w, http.StatusNotFound, errors.New("that user isn't in this room"))
+		return
+	}
+
+	if membership.UserID == requester.UserID {
+		if requester.IsOwner() {
+			utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("owners can't leave their own room"))
+			return
+		}
+	} else if !requester.CanModerate() || !requester.Outranks(membership) {
+		utils.WriteErrorResponse(w, http.StatusForbidden, errors.New("you can't remove that user from this room"))
+		return
+	}
+
+	tx := s.chatroomDB.DB.Delete(&membership)
+	if tx.Error != nil {
+		logger.Errorf("failed to remove member: %s", tx.Error.Error())
+		utils.WriteErrorResponse(w, http.StatusBadRequest,
+			errors.New("could not remove the member at this time, please try again"))
+		return
+	}
+
+	if membership.IsActive() {
+		s.announceRemoval(room.ID, membership, MembershipRemoved)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// BanMember is a handler that bans a user from a room, removing them if they're in it.
+// Banned users can't see the room, join it or be invited to it
+func (s *Server) BanMember(w http.ResponseWriter, r *http.Request) {
+	logger := s.logger.WithField("method", "BanMember")
+
+	room, requester, ok := s.roomFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if room.IsDirect() {
+		utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("nobody can be banned from direct conversations"))
+		return
+	}
+
+	membership, ok := s.memberFromRequest(w, r, room)
+	if !ok {
+		return
+	}
+
+	if membership.UserID == requester.UserID || !requester.CanModerate() || !requester.Outranks(membership) {
+		utils.WriteErrorResponse(w, http.StatusForbidden, errors.New("you can't ban that user from this room"))
+		return
+	}
+
+	if membership.IsBanned() {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	wasMember := membership.IsActive()
+	membership.Status = models.MembershipBanned
+	membership.Role = models.RoleMember
+	if membership.ID == 0 {
+		membership.Init()
+	}
+
+	tx := s.chatroomDB.DB.Omit(clause.Associations).Save(&membership)
+	if tx.Error != nil {
+		logger.Errorf("failed to ban member: %s", tx.Error.Error())
+		utils.WriteErrorResponse(w, http.StatusBadRequest,
+			errors.New("could not ban the user at this time, please try again"))
+		return
+	}
+
+	// Anyone can be following a public room, member or not
+	if wasMember || !room.IsPrivate() {
+		s.announceRemoval(room.ID, membership, MembershipBanned)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// UnbanMember is a handler that lifts a user's ban from a room
+func (s *Server) UnbanMember(w http.ResponseWriter, r *http.Request) {
+	logger := s.logger.WithField("method", "UnbanMember")
+
+	room, requester, ok := s.roomFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if !requester.CanModerate() {
+		utils.WriteErrorResponse(w, http.StatusForbidden, errors.New("only moderators can lift bans"))
+		return
+	}
+
+	membership, ok := s.memberFromRequest(w, r, room)
+	if !ok {
+		return
+	}
+
+	if !membership.IsBanned() {
+		utils.WriteErrorResponse(w, http.StatusNotFound, errors.New("that user isn't banned from this room"))
+		return
+	}
+
+	tx := s.chatroomDB.DB.Delete(&membership)
+	if tx.Error != nil {
+		logger.Errorf("failed to lift ban: %s", tx.Error.Error())
+		utils.WriteErrorResponse(w, http.StatusBadRequest,
+			errors.New("could not lift the ban at this time, please try again"))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// SetMemberRole is a handler that makes a member a moderator, or a moderator a plain member.
+// Only the room's owner can change roles
+func (s *Server) SetMemberRole(w http.ResponseWriter, r *http.Request) {
+	logger := s.logger.WithField("method", "SetMemberRole")
+
+	room, requester, ok := s.roomFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if !requester.IsOwner() {
+		utils.WriteErrorResponse(w, http.StatusForbidden, errors.New("only the room's owner can change roles"))
+		return
+	}
+
+	var request RoleRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		logger.Errorf("could not unmarshal request body: %s", err.Error())
+		utils.WriteErrorResponse(w, http.StatusBadRequest, err)
+		return
+	}
+
+	err = models.ValidRole(request.Role)
+	if err != nil {
+		utils.WriteErrorResponse(w, http.StatusBadRequest, err)
+		return
+	}
+
+	membership, ok := s.memberFromRequest(w, r, room)
+	if !ok {
+		return
+	}
+
+	if membership.UserID == requester.UserID {
+		utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("owners can't change their own role"))
+		return
+	}
+
+	// Anyone in a public room can be made a moderator, they don't need to have joined it
+	if membership.Status == "" && !room.IsPrivate() {
+		membership.Init()
+	}
+
+	if !membership.IsActive() {
+		utils.WriteErrorResponse(w, http.StatusNotFound, errors.New("that user isn't in this room"))
+		return
+	}
+
+	membership.Role = request.Role
+	tx := s.chatroomDB.DB.Omit(clause.Associations).Save(&membership)
+	if tx.Error != nil {
+		logger.Errorf("failed to change role: %s", tx.Error.Error())
+		utils.WriteErrorResponse(w, http.StatusBadRequest,
+			errors.New("could not change the role at this time, please try again"))
+		return
+	}
+
+	responsePayload := MembershipEvent{
+		Event:    MembershipRoleChanged,
+		UserID:   membership.UserID,
+		Username: membership.User.Username,
+		Role:     membership.Role,
+	}
+	s.broadcast <- NewEnvelope(KindMembership, room.ID, responsePayload)
+
+	resp, _ := json.Marshal(&responsePayload)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(resp)
+}
+
+// announceRemoval tells a room someone was removed from it, then stops sending them its events.
+// The room, including the removed user, hears about it before they're cut off
+func (s *Server) announceRemoval(roomID uint, membership models.RoomMembership, event string) {
+	membershipEvent := MembershipEvent{
+		Event:  event,
+		UserID: membership.UserID,
+	}
+	if membership.User != nil {
+		membershipEvent.Username = membership.User.Username
+	}
+
+	s.broadcast <- NewEnvelope(KindMembership, roomID, membershipEvent)
+	s.evict <- &eviction{
+		userID: membership.UserID,
+		roomID: roomID,
+	}
+}
+
+// createRoomWithOwner saves a new room along with its creator's membership
+func (s *Server) createRoomWithOwner(room *models.Room, userID uint) error {
+	return s.chatroomDB.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Create(room).Error
+		if err != nil {
+			return err
+		}
+
+		membership := models.RoomMembership{
+			RoomID: room.ID,
+			UserID: userID,
+			Role:   models.RoleOwner,
+		}
+		membership.Init()
+
+		return tx.Create(&membership).Error
+	})
+}
@@ -0,0 +1,36 @@
+package service_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/msanatan/go-chatroom/app/service"
+)
+
+func Test_EvictedUsersCantUseTheRoom(t *testing.T) {
+	wsServer := service.NewServer(nil, nil, nil, "", "/", testLogger)
+	go wsServer.Run()
+
+	alice, closeAlice := dialTestServer(t, wsServer, "/1", 1, "alice")
+	defer closeAlice()
+	readEnvelope(t, alice)
+	bob, closeBob := dialTestServer(t, wsServer, "/1", 2, "bob")
+	defer closeBob()
+	readEnvelope(t, alice)
+	readEnvelope(t, bob)
+
+	wsServer.Evict(2, 1)
+	// The hub handles requests in order, so once the marker arrives bob is out of the room
+	wsServer.SendToUsers([]uint{2}, service.NewEnvelope(service.KindSystem, 0, nil))
+	if envelope := readEnvelope(t, bob); envelope.Kind != service.KindSystem {
+		t.Fatalf("was expecting the marker but received %+v", envelope)
+	}
+
+	bob.WriteJSON(service.NewEnvelope(service.KindTyping, 1, service.TypingEvent{Typing: true}))
+	envelope := readReply(t, bob)
+	var errorPayload service.ErrorPayload
+	json.Unmarshal(envelope.Payload, &errorPayload)
+	if envelope.Kind != service.KindError || errorPayload.Code != service.ErrCodeRejected {
+		t.Errorf("was expecting bob's typing to be rejected but received %+v", envelope)
+	}
+}
@@ -0,0 +1,184 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/msanatan/go-chatroom/app/models"
+	"github.com/msanatan/go-chatroom/utils"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// findMentioned works out who a message mentions and how. Users named directly
+// take precedence over @room, which takes precedence over @here. Authors are never
+// notified of their own mentions, and users who can't use the room are left out
+func (s *Server) findMentioned(message models.Message, room models.Room) (map[uint]string, error) {
+	usernames, everyone, here := models.ParseMentions(message.Text)
+	mentioned := make(map[uint]string)
+
+	if here {
+		query := &presenceQuery{
+			roomID: room.ID,
+			result: make(chan []PresenceUser, 1),
+		}
+		s.presenceQueries <- query
+		for _, user := range <-query.result {
+			mentioned[user.ID] = models.MentionHere
+		}
+	}
+
+	if everyone {
+		var memberIDs []uint
+		tx := s.chatroomDB.DB.Model(&models.RoomMembership{}).
+			Where("room_id = ? AND status = ?", room.ID, models.MembershipActive).Pluck("user_id", &memberIDs)
+		if tx.Error != nil {
+			return nil, tx.Error
+		}
+
+		for _, userID := range memberIDs {
+			mentioned[userID] = models.MentionRoom
+		}
+	}
+
+	if len(usernames) > 0 {
+		tx := s.chatroomDB.DB.Model(&models.User{}).Where("LOWER(username) IN ?", usernames)
+		if room.IsPrivate() {
+			tx = tx.Where("id IN (?)", s.chatroomDB.DB.Model(&models.RoomMembership{}).Select("user_id").
+				Where("room_id = ? AND status = ?", room.ID, models.MembershipActive))
+		} else {
+			tx = tx.Where("id NOT IN (?)", s.chatroomDB.DB.Model(&models.RoomMembership{}).Select("user_id").
+				Where("room_id = ? AND status = ?", room.ID, models.MembershipBanned))
+		}
+
+		var userIDs []uint
+		tx = tx.Pluck("id", &userIDs)
+		if tx.Error != nil {
+			return nil, tx.Error
+		}
+
+		for _, userID := range userIDs {
+			mentioned[userID] = models.MentionUser
+		}
+	}
+
+	delete(mentioned, message.UserID)
+	return mentioned, nil
+}
+
+// notifyMentions stores who a new message mentions, and sends them a notification
+// on all their connections, whichever rooms they're following
+func (s *Server) notifyMentions(message models.Message, room models.Room, payload MessagePayload) {
+	logger := s.logger.WithField("method", "notifyMentions")
+
+	mentioned, err := s.findMentioned(message, room)
+	if err != nil {
+		logger.Errorf("could not find mentioned users: %s", err.Error())
+		return
+	}
+
+	if len(mentioned) == 0 {
+		return
+	}
+
+	var mentions []models.Mention
+	byKind := make(map[string][]uint)
+	for userID, kind := range mentioned {
+		mention := models.Mention{
+			MessageID: message.ID,
+			UserID:    userID,
+			Kind:      kind,
+		}
+		mention.Init()
+		mentions = append(mentions, mention)
+		byKind[kind] = append(byKind[kind], userID)
+	}
+
+	tx := s.chatroomDB.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&mentions)
+	if tx.Error != nil {
+		// The live notifications are still worth sending
+		logger.Errorf("could not save mentions: %s", tx.Error.Error())
+	}
+
+	for kind, userIDs := range byKind {
+		s.toUsers <- &usersMessage{
+			userIDs: userIDs,
+			message: NewEnvelope(KindMention, room.ID, MentionPayload{
+				Kind:     kind,
+				RoomName: room.Name,
+				Message:  payload,
+			}),
+		}
+	}
+}
+
+// GetMentions returns a page of the messages that mentioned the requester, newest first.
+// Pass the response's nextCursor as before to fetch older mentions
+func (s *Server) GetMentions(w http.ResponseWriter, r *http.Request) {
+	logger := s.logger.WithField("method", "GetMentions")
+
+	page, err := parsePageQuery(r.URL.Query())
+	if err == nil && page.after != 0 {
+		err = errors.New("mentions can only be paged back with before")
+	}
+	if err != nil {
+		logger.Errorf("page query is not valid: %s", err.Error())
+		utils.WriteErrorResponse(w, http.StatusBadRequest, err)
+		return
+	}
+
+	// Mentions in deleted messages, or in rooms the user was since removed from, aren't shown
+	userID, _ := userFromContext(r.Context())
+	rooms := visibleRooms(s.chatroomDB.DB.Session(&gorm.Session{NewDB: true}).Model(&models.Room{}).Select("rooms.id"), userID)
+	tx := s.chatroomDB.DB.Joins("JOIN messages ON messages.id = mentions.message_id AND messages.deleted_at IS NULL").
+		Where("mentions.user_id = ? AND messages.room_id IN (?)", userID, rooms)
+	if page.before != 0 {
+		tx = tx.Where("mentions.id < ?", page.before)
+	}
+
+	// Fetch an extra mention to find out if there's another page
+	var mentions []models.Mention
+	tx = tx.Order("mentions.id desc").Limit(page.limit + 1).
+		Preload("Message.User").Preload("Message.Room").Preload("Message.Attachments").Find(&mentions)
+	if tx.Error != nil {
+		logger.Errorf("could not pull mentions: %s", tx.Error.Error())
+		utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("could not pull your mentions"))
+		return
+	}
+
+	var nextCursor uint
+	if len(mentions) > page.limit {
+		mentions = mentions[:page.limit]
+		nextCursor = mentions[len(mentions)-1].ID
+	}
+
+	mentionsPayload := []MentionPayload{}
+	for _, mention := range mentions {
+		if mention.Message == nil {
+			continue
+		}
+
+		payload := MentionPayload{
+			ID:      mention.ID,
+			Kind:    mention.Kind,
+			Message: newMessagePayload(*mention.Message),
+		}
+		if mention.Message.Room != nil {
+			payload.RoomName = mention.Message.Room.Name
+		}
+
+		mentionsPayload = append(mentionsPayload, payload)
+	}
+
+	responsePayload := MentionsPayload{
+		Mentions:   mentionsPayload,
+		Size:       len(mentionsPayload),
+		NextCursor: nextCursor,
+	}
+
+	resp, _ := json.Marshal(&responsePayload)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(resp)
+}
@@ -0,0 +1,118 @@
+package service
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+
+	"github.com/msanatan/go-chatroom/app/models"
+	"gorm.io/gorm"
+)
+
+const (
+	// defaultPageSize is how many messages are returned when no limit is given
+	defaultPageSize = 50
+	// maxPageSize caps the limit clients can ask for
+	maxPageSize = 100
+)
+
+// pageQuery describes which page of messages a client wants. Before and after
+// are message IDs, with neither set the newest page is returned
+type pageQuery struct {
+	before uint
+	after  uint
+	limit  int
+}
+
+// parsePageQuery reads the before, after and limit query parameters
+func parsePageQuery(values url.Values) (pageQuery, error) {
+	page := pageQuery{limit: defaultPageSize}
+
+	if before := values.Get("before"); before != "" {
+		id, err := strconv.ParseUint(before, 10, 32)
+		if err != nil || id == 0 {
+			return page, errors.New("before must be a message ID")
+		}
+		page.before = uint(id)
+	}
+
+	if after := values.Get("after"); after != "" {
+		id, err := strconv.ParseUint(after, 10, 32)
+		if err != nil || id == 0 {
+			return page, errors.New("after must be a message ID")
+		}
+		page.after = uint(id)
+	}
+
+	if page.before != 0 && page.after != 0 {
+		return page, errors.New("only one of before and after can be used")
+	}
+
+	if limit := values.Get("limit"); limit != "" {
+		size, err := strconv.Atoi(limit)
+		if err != nil || size < 1 {
+			return page, errors.New("limit must be a positive number")
+		}
+		page.limit = size
+	}
+
+	if page.limit > maxPageSize {
+		page.limit = maxPageSize
+	}
+
+	return page, nil
+}
+
+// findMessagesPage runs a message query for one page, returning the messages in
+// chronological order along with the cursors for the older and newer pages, which
+// are 0 when there's nothing more to fetch in that direction
+func findMessagesPage(tx *gorm.DB, page pageQuery) ([]models.Message, uint, uint, error) {
+	if page.after != 0 {
+		tx = tx.Where("messages.id > ?", page.after).Order("messages.id asc")
+	} else {
+		if page.before != 0 {
+			tx = tx.Where("messages.id < ?", page.before)
+		}
+		tx = tx.Order("messages.id desc")
+	}
+
+	// Fetch an extra message to find out if there's another page
+	var messages []models.Message
+	err := tx.Limit(page.limit + 1).Preload("User").Preload("Attachments").Find(&messages).Error
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	hasMore := len(messages) > page.limit
+	if hasMore {
+		messages = messages[:page.limit]
+	}
+
+	if page.after == 0 {
+		for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+			messages[i], messages[j] = messages[j], messages[i]
+		}
+	}
+
+	if len(messages) == 0 {
+		return messages, 0, 0, nil
+	}
+
+	var nextCursor, prevCursor uint
+	oldest, newest := messages[0].ID, messages[len(messages)-1].ID
+	if page.after != 0 {
+		nextCursor = oldest
+		if hasMore {
+			prevCursor = newest
+		}
+	} else {
+		if hasMore {
+			nextCursor = oldest
+		}
+		if page.before != 0 {
+			prevCursor = newest
+		}
+	}
+
+	return messages, nextCursor, prevCursor, nil
+}
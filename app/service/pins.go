@@ -0,0 +1,253 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/msanatan/go-chatroom/app/models"
+	"github.com/msanatan/go-chatroom/utils"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// isSiteAdmin tells if a user runs the site
+func (s *Server) isSiteAdmin(userID uint) bool {
+	var user models.User
+	tx := s.chatroomDB.DB.First(&user, userID)
+	return tx.Error == nil && user.IsAdmin
+}
+
+// findPinnableMessage loads the message in the URL, making sure the requester can pin
+// messages in its room: they need to own the room or be a site admin. Site admins can pin
+// messages in private rooms they aren't in. When it returns false an error response was already written
+func (s *Server) findPinnableMessage(w http.ResponseWriter, r *http.Request) (models.Message, bool) {
+	logger := s.logger.WithField("method", "findPinnableMessage")
+	var message models.Message
+
+	vars := mux.Vars(r)
+	messageID, err := strconv.ParseUint(vars["id"], 10, 32)
+	if err != nil {
+		logger.Errorf("message ID is not valid: %s", err.Error())
+		utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("message ID is not valid"))
+		return message, false
+	}
+
+	tx := s.chatroomDB.DB.Preload("User").Preload("Attachments").First(&message, messageID)
+	if tx.Error != nil {
+		logger.Errorf("could not find message: %s", tx.Error.Error())
+		utils.WriteErrorResponse(w, http.StatusNotFound, errors.New("no message found with that ID"))
+		return message, false
+	}
+
+	userID, _ := userFromContext(r.Context())
+	var room models.Room
+	if s.isSiteAdmin(userID) {
+		tx = s.chatroomDB.DB.First(&room, message.RoomID)
+		if tx.Error != nil {
+			logger.Errorf("could not find room: %s", tx.Error.Error())
+			utils.WriteErrorResponse(w, http.StatusNotFound, errors.New("no room found with that ID"))
+			return message, false
+		}
+	} else {
+		var membership models.RoomMembership
+		room, membership, err = s.findRoomMembership(userID, message.RoomID)
+		if err != nil {
+			writeStatusError(w, http.StatusBadRequest, err)
+			return message, false
+		}
+
+		if !membership.IsOwner() {
+			utils.WriteErrorResponse(w, http.StatusForbidden, errors.New("only the room's owner can pin messages"))
+			return message, false
+		}
+	}
+
+	if room.IsArchived() {
+		utils.WriteErrorResponse(w, http.StatusForbidden, errors.New("this room is archived"))
+		return message, false
+	}
+
+	return message, true
+}
+
+// PinMessage is a handler that pins a message in its room
+func (s *Server) PinMessage(w http.ResponseWriter, r *http.Request) {
+	logger := s.logger.WithField("method", "PinMessage")
+
+	message, ok := s.findPinnableMessage(w, r)
+	if !ok {
+		return
+	}
+
+	userID, username := userFromContext(r.Context())
+	pin := models.Pin{
+		RoomID:    message.RoomID,
+		MessageID: message.ID,
+		PinnedBy:  userID,
+	}
+	pin.Init()
+
+	errTooManyPins := fmt.Errorf("a room can't have more than %d pinned messages", models.MaxPinsPerRoom)
+	errAlreadyPinned := errors.New("this message is already pinned")
+	err := s.chatroomDB.DB.Transaction(func(tx *gorm.DB) error {
+		// Locking the room's row makes pins added at the same time wait
+		// for each other, so they can't go over the limit or pin a message twice
+		var room models.Room
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&room, message.RoomID).Error
+		if err != nil {
+			return err
+		}
+
+		var pinned int64
+		err = tx.Model(&models.Pin{}).Where("message_id = ?", message.ID).Count(&pinned).Error
+		if err != nil {
+			return err
+		}
+
+		if pinned > 0 {
+			return errAlreadyPinned
+		}
+
+		var count int64
+		err = tx.Model(&models.Pin{}).Where("room_id = ?", message.RoomID).Count(&count).Error
+		if err != nil {
+			return err
+		}
+
+		if count >= models.MaxPinsPerRoom {
+			return errTooManyPins
+		}
+
+		return tx.Create(&pin).Error
+	})
+	if err == errTooManyPins {
+		utils.WriteErrorResponse(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err == errAlreadyPinned {
+		utils.WriteErrorResponse(w, http.StatusConflict, err)
+		return
+	}
+
+	if err != nil {
+		logger.Errorf("failed to pin message: %s", err.Error())
+		utils.WriteErrorResponse(w, http.StatusInternalServerError,
+			errors.New("could not pin the message at this time, please try again"))
+		return
+	}
+
+	s.broadcast <- NewEnvelope(KindSystem, message.RoomID, SystemPayload{
+		Event:     SystemMessagePinned,
+		Message:   username + " pinned a message",
+		MessageID: message.ID,
+	})
+
+	responsePayload := PinPayload{
+		Message:  newMessagePayload(message),
+		PinnedBy: username,
+		Pinned:   pin.CreatedAt.Format(time.RFC1123Z),
+	}
+
+	resp, _ := json.Marshal(&responsePayload)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(resp)
+}
+
+// UnpinMessage is a handler that unpins a message
+func (s *Server) UnpinMessage(w http.ResponseWriter, r *http.Request) {
+	logger := s.logger.WithField("method", "UnpinMessage")
+
+	message, ok := s.findPinnableMessage(w, r)
+	if !ok {
+		return
+	}
+
+	tx := s.chatroomDB.DB.Where("message_id = ?", message.ID).Delete(&models.Pin{})
+	if tx.Error != nil {
+		logger.Errorf("failed to unpin message: %s", tx.Error.Error())
+		utils.WriteErrorResponse(w, http.StatusBadRequest,
+			errors.New("could not unpin the message at this time, please try again"))
+		return
+	}
+
+	if tx.RowsAffected == 0 {
+		utils.WriteErrorResponse(w, http.StatusNotFound, errors.New("this message isn't pinned"))
+		return
+	}
+
+	_, username := userFromContext(r.Context())
+	s.broadcast <- NewEnvelope(KindSystem, message.RoomID, SystemPayload{
+		Event:     SystemMessageUnpinned,
+		Message:   username + " unpinned a message",
+		MessageID: message.ID,
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetPins is a handler that lists a room's pinned messages, the most recently pinned first
+func (s *Server) GetPins(w http.ResponseWriter, r *http.Request) {
+	logger := s.logger.WithField("method", "GetPins")
+
+	room, _, ok := s.roomFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	var pins []models.Pin
+	tx := s.chatroomDB.DB.Where("room_id = ?", room.ID).Order("created_at desc").Preload("Message.User").Preload("Message.Attachments").Find(&pins)
+	if tx.Error != nil {
+		logger.Errorf("could not pull pins: %s", tx.Error.Error())
+		utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("could not pull the pinned messages"))
+		return
+	}
+
+	var pinnerIDs []uint
+	for _, pin := range pins {
+		pinnerIDs = append(pinnerIDs, pin.PinnedBy)
+	}
+
+	pinners := make(map[uint]string)
+	if len(pinnerIDs) > 0 {
+		var users []models.User
+		tx = s.chatroomDB.DB.Where("id IN ?", pinnerIDs).Find(&users)
+		if tx.Error != nil {
+			logger.Errorf("could not pull pinners: %s", tx.Error.Error())
+		}
+
+		for _, user := range users {
+			pinners[user.ID] = user.Username
+		}
+	}
+
+	pinsPayload := []PinPayload{}
+	for _, pin := range pins {
+		// Pins of deleted messages aren't worth showing
+		if pin.Message == nil {
+			continue
+		}
+
+		pinsPayload = append(pinsPayload, PinPayload{
+			Message:  newMessagePayload(*pin.Message),
+			PinnedBy: pinners[pin.PinnedBy],
+			Pinned:   pin.CreatedAt.Format(time.RFC1123Z),
+		})
+	}
+
+	responsePayload := PinsPayload{
+		Pins: pinsPayload,
+		Size: len(pinsPayload),
+	}
+
+	resp, _ := json.Marshal(&responsePayload)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(resp)
+}
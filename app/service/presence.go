@@ -0,0 +1,176 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/msanatan/go-chatroom/utils"
+)
+
+// defaultPresenceGracePeriod is how long a user can be without connections to
+// a room before they're announced as having left. It stops page reloads and
+// closing one of many tabs from flooding the room with join/leave events
+const defaultPresenceGracePeriod = 5 * time.Second
+
+// Presence events
+const (
+	PresenceJoin  = "join"
+	PresenceLeave = "leave"
+)
+
+// presenceEntry tracks one user's connections to a room. Once they have none left,
+// expiry announces they're gone when the grace period ends at expiresAt
+type presenceEntry struct {
+	username    string
+	connections int
+	expiry      *time.Timer
+	expiresAt   time.Time
+}
+
+// presenceKey identifies a user in a room
+type presenceKey struct {
+	roomID uint
+	userID uint
+}
+
+// presenceQuery asks the hub who is in a room
+type presenceQuery struct {
+	roomID uint
+	result chan []PresenceUser
+}
+
+// userJoined counts a new connection from the client's user to a room,
+// announcing them if they weren't already there
+func (s *Server) userJoined(client *WSClient, roomID uint) {
+	if s.presence[roomID] == nil {
+		s.presence[roomID] = make(map[uint]*presenceEntry)
+	}
+
+	entry, ok := s.presence[roomID][client.userID]
+	if !ok {
+		entry = &presenceEntry{username: client.username}
+		s.presence[roomID][client.userID] = entry
+		s.broadcastToClients(NewEnvelope(KindPresence, roomID, PresenceEvent{
+			Event:    PresenceJoin,
+			UserID:   client.userID,
+			Username: client.username,
+		}))
+	}
+
+	// Coming back during the grace period means they never left
+	if entry.expiry != nil {
+		entry.expiry.Stop()
+	}
+	entry.connections++
+}
+
+// userLeft removes one of the client's user connections to a room. When it was
+// their last, they're given a grace period to reconnect before they're announced as gone
+func (s *Server) userLeft(client *WSClient, roomID uint) {
+	entry, ok := s.presence[roomID][client.userID]
+	if !ok {
+		return
+	}
+
+	entry.connections--
+	if entry.connections > 0 {
+		return
+	}
+
+	// Each (room, user) has one timer, which starts over every time they leave
+	entry.expiresAt = time.Now().Add(s.presenceGracePeriod)
+	if entry.expiry != nil {
+		entry.expiry.Reset(s.presenceGracePeriod)
+		return
+	}
+
+	key := presenceKey{roomID: roomID, userID: client.userID}
+	entry.expiry = time.AfterFunc(s.presenceGracePeriod, func() {
+		s.presenceExpired <- key
+	})
+}
+
+// expirePresence announces a user left a room, unless they reconnected during the grace period
+func (s *Server) expirePresence(key presenceKey) {
+	entry, ok := s.presence[key.roomID][key.userID]
+	if !ok || entry.connections > 0 {
+		return
+	}
+
+	// A timer that fired just before being reset is early for the new grace period
+	if time.Now().Before(entry.expiresAt) {
+		return
+	}
+
+	delete(s.presence[key.roomID], key.userID)
+	if len(s.presence[key.roomID]) == 0 {
+		delete(s.presence, key.roomID)
+	}
+
+	s.broadcastToClients(NewEnvelope(KindPresence, key.roomID, PresenceEvent{
+		Event:    PresenceLeave,
+		UserID:   key.userID,
+		Username: entry.username,
+	}))
+}
+
+// usersInRoom lists the users in a room, sorted by username
+func (s *Server) usersInRoom(roomID uint) []PresenceUser {
+	users := []PresenceUser{}
+	for userID, entry := range s.presence[roomID] {
+		users = append(users, PresenceUser{
+			ID:       userID,
+			Username: entry.username,
+		})
+	}
+
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Username < users[j].Username
+	})
+
+	return users
+}
+
+// GetPresence lists the users that are currently in a room
+func (s *Server) GetPresence(w http.ResponseWriter, r *http.Request) {
+	logger := s.logger.WithField("method", "GetPresence")
+
+	vars := mux.Vars(r)
+	roomID, err := strconv.ParseUint(vars["roomId"], 10, 32)
+	if err != nil {
+		logger.Errorf("room ID is not valid: %s", err.Error())
+		utils.WriteErrorResponse(w, http.StatusBadRequest,
+			errors.New("you can only get presence from a valid room ID"))
+		return
+	}
+
+	userID, _ := userFromContext(r.Context())
+	err = s.canSubscribe(userID, uint(roomID))
+	if err != nil {
+		writeStatusError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	query := &presenceQuery{
+		roomID: uint(roomID),
+		result: make(chan []PresenceUser, 1),
+	}
+	s.presenceQueries <- query
+	users := <-query.result
+
+	responsePayload := PresencePayload{
+		RoomID: uint(roomID),
+		Users:  users,
+		Size:   len(users),
+	}
+
+	resp, _ := json.Marshal(&responsePayload)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(resp)
+}
@@ -0,0 +1,53 @@
+package service_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/msanatan/go-chatroom/app/service"
+)
+
+func Test_PresenceAnnouncesJoins(t *testing.T) {
+	wsServer := service.NewServer(nil, nil, nil, "", "/", testLogger)
+	go wsServer.Run()
+
+	alice, closeAlice := dialTestServer(t, wsServer, "/1", 1, "alice")
+	defer closeAlice()
+	if envelope := readEnvelope(t, alice); envelope.Kind != service.KindPresence {
+		t.Fatalf("was expecting a presence event but received %q", envelope.Kind)
+	}
+
+	// A second tab from alice shouldn't be announced
+	aliceTab, closeAliceTab := dialTestServer(t, wsServer, "/1", 1, "alice")
+	defer closeAliceTab()
+	bob, closeBob := dialTestServer(t, wsServer, "/1", 2, "bob")
+	defer closeBob()
+
+	envelope := readEnvelope(t, alice)
+	var event service.PresenceEvent
+	json.Unmarshal(envelope.Payload, &event)
+	if event.Event != service.PresenceJoin || event.Username != "bob" {
+		t.Errorf("was expecting bob to join but received %+v", event)
+	}
+
+	readEnvelope(t, aliceTab)
+	readEnvelope(t, bob)
+
+	r := mux.NewRouter()
+	r.HandleFunc("/rooms/{roomId}/presence", wsServer.GetPresence)
+	recorder := httptest.NewRecorder()
+	r.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/rooms/1/presence", nil))
+
+	var presence service.PresencePayload
+	json.Unmarshal(recorder.Body.Bytes(), &presence)
+	if presence.Size != 2 {
+		t.Fatalf("was expecting 2 users in the room but found %d", presence.Size)
+	}
+
+	if presence.Users[0].Username != "alice" || presence.Users[1].Username != "bob" {
+		t.Errorf("wrong users returned: %+v", presence.Users)
+	}
+}
@@ -0,0 +1,223 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// ProtocolVersion is the version of the websocket protocol spoken by the server.
+// Frames with any other version are rejected
+const ProtocolVersion = 1
+
+// EventKind describes what an envelope's payload contains
+type EventKind string
+
+// The kinds of events that can cross the websocket
+const (
+	// KindMessage carries a chat message (MessagePayload), sent by clients and the server
+	KindMessage EventKind = "message"
+	// KindAck confirms a client's frame was processed (AckPayload)
+	KindAck EventKind = "ack"
+	// KindError reports a client's frame could not be processed (ErrorPayload)
+	KindError EventKind = "error"
+	// KindPresence announces users joining or leaving a room
+	KindPresence EventKind = "presence"
+	// KindTyping signals a user started or stopped typing
+	KindTyping EventKind = "typing"
+	// KindSystem carries notices generated by the server itself (SystemPayload)
+	KindSystem EventKind = "system"
+	// KindSubscribe asks the server to start sending a room's events to the connection
+	KindSubscribe EventKind = "subscribe"
+	// KindUnsubscribe asks the server to stop sending a room's events to the connection
+	KindUnsubscribe EventKind = "unsubscribe"
+	// KindMessageEdited carries a message whose text changed (MessagePayload)
+	KindMessageEdited EventKind = "message.edited"
+	// KindMessageDeleted announces a message was removed (MessageDeletedEvent)
+	KindMessageDeleted EventKind = "message.deleted"
+	// KindReactionAdd and KindReactionRemove are sent by clients to react to a message (ReactionRequest)
+	KindReactionAdd    EventKind = "reaction.add"
+	KindReactionRemove EventKind = "reaction.remove"
+	// KindReactionAdded and KindReactionRemoved tell a room a message's reactions changed (ReactionEvent)
+	KindReactionAdded   EventKind = "reaction.added"
+	KindReactionRemoved EventKind = "reaction.removed"
+	// KindThreadUpdated tells a room a thread got a new reply (ThreadUpdatedEvent)
+	KindThreadUpdated EventKind = "thread.updated"
+	// KindInvitation tells a user they were invited to a private room (InvitationPayload)
+	KindInvitation EventKind = "invitation"
+	// KindMembership tells a room someone joined or was removed from it (MembershipEvent)
+	KindMembership EventKind = "membership"
+	// KindRead is sent by clients to move their read marker in a room forward (ReadRequest)
+	KindRead EventKind = "read"
+	// KindReadMarker tells a user's other connections their read marker moved (ReadMarkerEvent)
+	KindReadMarker EventKind = "read.marker"
+	// KindReceipts tells a room how far some of its members read (ReceiptsEvent)
+	KindReceipts EventKind = "receipts"
+	// KindMention tells a user a new message mentioned them, whichever room it's in (MentionPayload)
+	KindMention EventKind = "mention"
+)
+
+// Error codes sent in ErrorPayload
+const (
+	ErrCodeInvalidFrame       = "invalid_frame"
+	ErrCodeUnsupportedVersion = "unsupported_version"
+	ErrCodeUnknownKind        = "unknown_kind"
+	ErrCodeInvalidPayload     = "invalid_payload"
+	ErrCodeRejected           = "rejected"
+	ErrCodeNotFound           = "not_found"
+	ErrCodeForbidden          = "forbidden"
+)
+
+var (
+	errMissingRoom = &ErrorPayload{
+		Code:    ErrCodeInvalidFrame,
+		Message: "this kind of frame needs a roomId",
+	}
+	errNotSubscribed = &ErrorPayload{
+		Code:    ErrCodeRejected,
+		Message: "you need to subscribe to a room before posting to it",
+	}
+)
+
+// Envelope wraps every frame sent over the websocket, in both directions.
+// RequestID is chosen by the client and echoed back in the matching ack or error
+type Envelope struct {
+	Version   int             `json:"v"`
+	Kind      EventKind       `json:"kind"`
+	RequestID string          `json:"requestId,omitempty"`
+	RoomID    uint            `json:"roomId,omitempty"`
+	Payload   json.RawMessage `json:"payload,omitempty"`
+}
+
+// AckPayload is returned when a client's frame is processed successfully
+type AckPayload struct {
+	ID      uint   `json:"id,omitempty"`
+	Seq     uint64 `json:"seq,omitempty"`
+	Created string `json:"created,omitempty"`
+}
+
+// SubscribePayload is the optional payload of a subscribe frame. Since is the
+// last sequence number the client saw in the room, the messages after it are
+// replayed before any live events
+type SubscribePayload struct {
+	Since uint64 `json:"since,omitempty"`
+}
+
+// ErrorPayload is returned when a client's frame could not be processed
+type ErrorPayload struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *ErrorPayload) Error() string {
+	return e.Message
+}
+
+// System events
+const (
+	SystemReplayTruncated = "replay.truncated"
+	SystemRoomRenamed     = "room.renamed"
+	SystemTopicChanged    = "room.topic"
+	SystemRoomArchived    = "room.archived"
+	SystemRoomUnarchived  = "room.unarchived"
+	SystemMessagePinned   = "message.pinned"
+	SystemMessageUnpinned = "message.unpinned"
+)
+
+// SystemPayload is a notice from the server, like a room's topic changing.
+// MessageID is set when the notice is about a message, like it being pinned
+type SystemPayload struct {
+	Event     string `json:"event"`
+	Message   string `json:"message,omitempty"`
+	MessageID uint   `json:"messageId,omitempty"`
+}
+
+// NewEnvelope wraps a payload in an envelope of the current protocol version
+func NewEnvelope(kind EventKind, roomID uint, payload interface{}) Envelope {
+	payloadJSON, _ := json.Marshal(payload)
+	return Envelope{
+		Version: ProtocolVersion,
+		Kind:    kind,
+		RoomID:  roomID,
+		Payload: payloadJSON,
+	}
+}
+
+// eventHandler processes a frame of a specific kind sent by a client.
+// A non-nil result is sent back to the client as an ack
+type eventHandler func(c *WSClient, envelope Envelope) (interface{}, error)
+
+// eventHandlers are the kinds of frames clients are allowed to send
+var eventHandlers = map[EventKind]eventHandler{
+	KindMessage:        handleMessage,
+	KindSubscribe:      handleSubscribe,
+	KindUnsubscribe:    handleUnsubscribe,
+	KindTyping:         handleTyping,
+	KindReactionAdd:    handleReaction,
+	KindReactionRemove: handleReaction,
+	KindRead:           handleRead,
+}
+
+// dispatch routes a frame to the handler for its kind, replying to the client
+// with an ack or an error frame
+func (c *WSClient) dispatch(envelope Envelope) {
+	logger := c.logger.WithField("method", "dispatch")
+
+	if envelope.Version != ProtocolVersion {
+		c.replyError(envelope, &ErrorPayload{
+			Code:    ErrCodeUnsupportedVersion,
+			Message: fmt.Sprintf("protocol version %d is not supported, use version %d", envelope.Version, ProtocolVersion),
+		})
+		return
+	}
+
+	handler, ok := eventHandlers[envelope.Kind]
+	if !ok {
+		c.replyError(envelope, &ErrorPayload{
+			Code:    ErrCodeUnknownKind,
+			Message: fmt.Sprintf("unknown event kind: %q", envelope.Kind),
+		})
+		return
+	}
+
+	result, err := handler(c, envelope)
+	if err != nil {
+		logger.Errorf("could not handle %s frame: %s", envelope.Kind, err.Error())
+		c.replyError(envelope, err)
+		return
+	}
+
+	if result != nil {
+		ack := NewEnvelope(KindAck, envelope.RoomID, result)
+		ack.RequestID = envelope.RequestID
+		c.reply(ack)
+	}
+}
+
+// replyError sends an error frame in response to one of the client's frames
+func (c *WSClient) replyError(envelope Envelope, err error) {
+	errorPayload, ok := err.(*ErrorPayload)
+	if !ok {
+		errorPayload = &ErrorPayload{
+			Code:    errorCode(err),
+			Message: err.Error(),
+		}
+	}
+
+	reply := NewEnvelope(KindError, envelope.RoomID, errorPayload)
+	reply.RequestID = envelope.RequestID
+	c.reply(reply)
+}
+
+// decodePayload unmarshals a frame's payload, reporting malformed payloads
+// with the right error code
+func decodePayload(envelope Envelope, payload interface{}) error {
+	err := json.Unmarshal(envelope.Payload, payload)
+	if err != nil {
+		return &ErrorPayload{
+			Code:    ErrCodeInvalidPayload,
+			Message: fmt.Sprintf("%s payload is not valid: %s", envelope.Kind, err.Error()),
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,178 @@
+package service_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/msanatan/go-chatroom/app/service"
+)
+
+// authenticateAs stands in for IsAuthenticated, putting a fixed user in the request context
+func authenticateAs(userID int, username string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = r.WithContext(context.WithValue(r.Context(), "userId", userID))
+		r = r.WithContext(context.WithValue(r.Context(), "username", username))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// dialTestServer connects a websocket client to the server as the given user.
+// The returned function closes the connection and the test server
+func dialTestServer(t *testing.T, wsServer *service.Server, path string, userID int, username string) (*websocket.Conn, func()) {
+	r := mux.NewRouter()
+	r.HandleFunc("/", service.ServeWs(wsServer, testClientConfig, testLogger))
+	r.HandleFunc("/{roomId}", service.ServeWs(wsServer, testClientConfig, testLogger))
+	testServer := httptest.NewServer(authenticateAs(userID, username, r))
+
+	wsURL := fmt.Sprintf("ws%s%s", strings.TrimPrefix(testServer.URL, "http"), path)
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		testServer.Close()
+		t.Fatalf("could not connect to websocket server: %s", err.Error())
+	}
+
+	return conn, func() {
+		conn.Close()
+		testServer.Close()
+	}
+}
+
+// readEnvelope waits for the next frame sent to a client
+func readEnvelope(t *testing.T, conn *websocket.Conn) service.Envelope {
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var envelope service.Envelope
+	err := conn.ReadJSON(&envelope)
+	if err != nil {
+		t.Fatalf("could not read frame: %s", err.Error())
+	}
+
+	return envelope
+}
+
+// readReply waits for the next ack or error sent to a client, skipping room events
+func readReply(t *testing.T, conn *websocket.Conn) service.Envelope {
+	for {
+		envelope := readEnvelope(t, conn)
+		if envelope.Kind == service.KindAck || envelope.Kind == service.KindError {
+			return envelope
+		}
+	}
+}
+
+func Test_DispatchRejectsBadFrames(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame string
+		code  string
+	}{
+		{
+			name:  "testing invalid JSON",
+			frame: `hello`,
+			code:  service.ErrCodeInvalidFrame,
+		},
+		{
+			name:  "testing unsupported version",
+			frame: `{"v":99,"kind":"message","requestId":"abc"}`,
+			code:  service.ErrCodeUnsupportedVersion,
+		},
+		{
+			name:  "testing unknown kind",
+			frame: `{"v":1,"kind":"dance","requestId":"abc"}`,
+			code:  service.ErrCodeUnknownKind,
+		},
+		{
+			name:  "testing invalid payload",
+			frame: `{"v":1,"kind":"message","requestId":"abc","payload":"hello"}`,
+			code:  service.ErrCodeInvalidPayload,
+		},
+	}
+
+	wsServer := service.NewServer(nil, nil, nil, "", "/", testLogger)
+	go wsServer.Run()
+	conn, closeConn := dialTestServer(t, wsServer, "/1", 1, "tester")
+	defer closeConn()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := conn.WriteMessage(websocket.TextMessage, []byte(tt.frame))
+			if err != nil {
+				t.Fatalf("could not send frame: %s", err.Error())
+			}
+
+			envelope := readReply(t, conn)
+			if envelope.Kind != service.KindError {
+				t.Fatalf("wrong kind returned. expected %q but received %q", service.KindError, envelope.Kind)
+			}
+
+			var errorPayload service.ErrorPayload
+			json.Unmarshal(envelope.Payload, &errorPayload)
+			if errorPayload.Code != tt.code {
+				t.Errorf("wrong error code returned. expected %q but received %q", tt.code, errorPayload.Code)
+			}
+		})
+	}
+}
+
+func Test_SubscribeToSeveralRooms(t *testing.T) {
+	wsServer := service.NewServer(nil, nil, nil, "", "/", testLogger)
+	go wsServer.Run()
+	conn, closeConn := dialTestServer(t, wsServer, "/", 1, "tester")
+	defer closeConn()
+
+	for _, roomID := range []uint{1, 2} {
+		conn.WriteJSON(service.Envelope{Version: 1, Kind: service.KindSubscribe, RoomID: roomID})
+		if envelope := readReply(t, conn); envelope.Kind != service.KindAck {
+			t.Fatalf("was expecting an ack for room %d but received %q", roomID, envelope.Kind)
+		}
+
+		if wsServer.ClientCount(roomID) != 1 {
+			t.Errorf("was expecting the client count of room %d to be 1 but it was %d", roomID, wsServer.ClientCount(roomID))
+		}
+	}
+
+	conn.WriteJSON(service.Envelope{Version: 1, Kind: service.KindUnsubscribe, RoomID: 1})
+	if envelope := readReply(t, conn); envelope.Kind != service.KindAck {
+		t.Fatalf("was expecting an ack but received %q", envelope.Kind)
+	}
+
+	if wsServer.ClientCount(1) != 0 {
+		t.Errorf("was expecting the client count of room 1 to be 0 but it was %d", wsServer.ClientCount(1))
+	}
+
+	if wsServer.ClientCount(2) != 1 {
+		t.Errorf("was expecting the client count of room 2 to be 1 but it was %d", wsServer.ClientCount(2))
+	}
+}
+
+func Test_PostingRequiresSubscription(t *testing.T) {
+	wsServer := service.NewServer(nil, nil, nil, "", "/", testLogger)
+	go wsServer.Run()
+	conn, closeConn := dialTestServer(t, wsServer, "/1", 1, "tester")
+	defer closeConn()
+
+	conn.WriteJSON(service.Envelope{
+		Version: 1,
+		Kind:    service.KindMessage,
+		RoomID:  2,
+		Payload: []byte(`{"message":"hello","type":"user"}`),
+	})
+
+	envelope := readReply(t, conn)
+	if envelope.Kind != service.KindError {
+		t.Fatalf("wrong kind returned. expected %q but received %q", service.KindError, envelope.Kind)
+	}
+
+	var errorPayload service.ErrorPayload
+	json.Unmarshal(envelope.Payload, &errorPayload)
+	if errorPayload.Code != service.ErrCodeRejected {
+		t.Errorf("wrong error code returned. expected %q but received %q", service.ErrCodeRejected, errorPayload.Code)
+	}
+}
@@ -0,0 +1,188 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/msanatan/go-chatroom/app/models"
+	"github.com/msanatan/go-chatroom/utils"
+	"gorm.io/gorm/clause"
+)
+
+// react adds or removes a user's emoji on a message, telling the message's room,
+// or its thread for replies, how many of that emoji it now has
+func (s *Server) react(userID uint, username string, messageID uint, emoji string, add bool) (ReactionEvent, error) {
+	logger := s.logger.WithField("method", "react")
+
+	var message models.Message
+	tx := s.chatroomDB.DB.First(&message, messageID)
+	if tx.Error != nil {
+		logger.Errorf("could not find message: %s", tx.Error.Error())
+		return ReactionEvent{}, newStatusError(http.StatusNotFound, "no message found with that ID")
+	}
+
+	_, err := s.findWritableRoom(userID, message.RoomID)
+	if err != nil {
+		return ReactionEvent{}, err
+	}
+
+	reaction := models.Reaction{
+		MessageID: message.ID,
+		UserID:    userID,
+		Emoji:     emoji,
+	}
+	reaction.Init()
+	err = reaction.Validate()
+	if err != nil {
+		logger.Errorf("reaction is not valid: %s", err.Error())
+		return ReactionEvent{}, err
+	}
+
+	kind := KindReactionAdded
+	if add {
+		// Reacting twice with the same emoji is a no-op
+		tx = s.chatroomDB.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&reaction)
+	} else {
+		kind = KindReactionRemoved
+		tx = s.chatroomDB.DB.Where("message_id = ? AND user_id = ? AND emoji = ?",
+			reaction.MessageID, reaction.UserID, reaction.Emoji).Delete(&models.Reaction{})
+		if tx.Error == nil && tx.RowsAffected == 0 {
+			return ReactionEvent{}, newStatusError(http.StatusNotFound, "you haven't reacted to this message with that emoji")
+		}
+	}
+
+	if tx.Error != nil {
+		logger.Errorf("could not save reaction: %s", tx.Error.Error())
+		return ReactionEvent{}, errors.New("could not update the reaction at this time, please try again")
+	}
+
+	var count int64
+	tx = s.chatroomDB.DB.Model(&models.Reaction{}).Where("message_id = ? AND emoji = ?", reaction.MessageID, reaction.Emoji).Count(&count)
+	if tx.Error != nil {
+		logger.Errorf("could not count reactions: %s", tx.Error.Error())
+	}
+
+	event := ReactionEvent{
+		MessageID: message.ID,
+		Emoji:     reaction.Emoji,
+		Count:     count,
+		UserID:    userID,
+		Username:  username,
+	}
+
+	s.broadcastMessageEvent(message, NewEnvelope(kind, message.RoomID, event))
+	return event, nil
+}
+
+// handleReaction adds or removes a reaction sent over the websocket
+func handleReaction(c *WSClient, envelope Envelope) (interface{}, error) {
+	var request ReactionRequest
+	err := decodePayload(envelope, &request)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = c.server.react(c.userID, c.username, request.MessageID, request.Emoji, envelope.Kind == KindReactionAdd)
+	if err != nil {
+		return nil, err
+	}
+
+	return AckPayload{ID: request.MessageID}, nil
+}
+
+// AddReaction is a handler that reacts to a message with an emoji
+func (s *Server) AddReaction(w http.ResponseWriter, r *http.Request) {
+	logger := s.logger.WithField("method", "AddReaction")
+
+	vars := mux.Vars(r)
+	messageID, err := strconv.ParseUint(vars["id"], 10, 32)
+	if err != nil {
+		logger.Errorf("message ID is not valid: %s", err.Error())
+		utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("message ID is not valid"))
+		return
+	}
+
+	var request ReactionRequest
+	err = json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		logger.Errorf("could not unmarshal request body: %s", err.Error())
+		utils.WriteErrorResponse(w, http.StatusBadRequest, err)
+		return
+	}
+
+	userID, username := userFromContext(r.Context())
+	responsePayload, err := s.react(userID, username, uint(messageID), request.Emoji, true)
+	if err != nil {
+		writeStatusError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	resp, _ := json.Marshal(&responsePayload)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(resp)
+}
+
+// RemoveReaction is a handler that takes back a user's emoji reaction to a message
+func (s *Server) RemoveReaction(w http.ResponseWriter, r *http.Request) {
+	logger := s.logger.WithField("method", "RemoveReaction")
+
+	vars := mux.Vars(r)
+	messageID, err := strconv.ParseUint(vars["id"], 10, 32)
+	if err != nil {
+		logger.Errorf("message ID is not valid: %s", err.Error())
+		utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("message ID is not valid"))
+		return
+	}
+
+	userID, username := userFromContext(r.Context())
+	responsePayload, err := s.react(userID, username, uint(messageID), vars["emoji"], false)
+	if err != nil {
+		writeStatusError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	resp, _ := json.Marshal(&responsePayload)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(resp)
+}
+
+// attachReactions adds the reaction counts of each message to their payloads
+func (s *Server) attachReactions(messages []MessagePayload) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	var messageIDs []uint
+	byID := make(map[uint]*MessagePayload)
+	for i := range messages {
+		messageIDs = append(messageIDs, messages[i].ID)
+		byID[messages[i].ID] = &messages[i]
+	}
+
+	var counts []struct {
+		MessageID uint
+		Emoji     string
+		Count     int64
+	}
+	// Emoji are listed in the order they were first used on the message
+	tx := s.chatroomDB.DB.Model(&models.Reaction{}).Select("message_id, emoji, COUNT(*) AS count").
+		Where("message_id IN ?", messageIDs).Group("message_id, emoji").Order("MIN(created_at) asc").Scan(&counts)
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	for _, count := range counts {
+		message := byID[count.MessageID]
+		message.Reactions = append(message.Reactions, ReactionCount{
+			Emoji: count.Emoji,
+			Count: count.Count,
+		})
+	}
+
+	return nil
+}
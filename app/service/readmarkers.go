@@ -0,0 +1,134 @@
+package service
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/msanatan/go-chatroom/app/models"
+	"github.com/msanatan/go-chatroom/utils"
+)
+
+// advanceReadMarker moves the user's read marker in a room forward to a message, or to the
+// room's latest message when seq is 0. Markers never move back, so the marker is returned
+// as it is when the user already read further
+func (s *Server) advanceReadMarker(userID uint, username string, roomID uint, seq uint64, except *WSClient) (ReadMarkerEvent, error) {
+	room, membership, err := s.findRoomMembership(userID, roomID)
+	if err != nil {
+		return ReadMarkerEvent{}, err
+	}
+
+	if seq == 0 || seq > room.LastSeq {
+		seq = room.LastSeq
+	}
+
+	// Public rooms the user never opened have nowhere to keep their marker yet
+	err = s.addMember(membership)
+	if err != nil {
+		return ReadMarkerEvent{}, err
+	}
+
+	return s.markRead(userID, username, room.ID, seq, except), nil
+}
+
+// markRead moves the user's read marker in a room forward to a message, telling the
+// user's other connections and the room if it moved. It returns where the marker ended up
+func (s *Server) markRead(userID uint, username string, roomID uint, seq uint64, except *WSClient) ReadMarkerEvent {
+	logger := s.logger.WithField("method", "markRead")
+
+	tx := s.chatroomDB.DB.Model(&models.RoomMembership{}).
+		Where("room_id = ? AND user_id = ? AND last_read_seq < ?", roomID, userID, seq).Update("last_read_seq", seq)
+	if tx.Error != nil {
+		logger.Errorf("could not move read marker: %s", tx.Error.Error())
+	}
+	moved := tx.Error == nil && tx.RowsAffected > 0
+
+	var membership models.RoomMembership
+	tx = s.chatroomDB.DB.Where("room_id = ? AND user_id = ?", roomID, userID).Limit(1).Find(&membership)
+	if tx.Error != nil {
+		logger.Errorf("could not find read marker: %s", tx.Error.Error())
+	}
+
+	event := ReadMarkerEvent{
+		RoomID:      roomID,
+		LastReadSeq: membership.LastReadSeq,
+	}
+
+	tx = s.chatroomDB.DB.Model(&models.Message{}).
+		Where("room_id = ? AND seq > ? AND parent_id IS NULL AND user_id <> ?", roomID, event.LastReadSeq, userID).
+		Count(&event.UnreadCount)
+	if tx.Error != nil {
+		logger.Errorf("could not count unread messages: %s", tx.Error.Error())
+	}
+
+	if moved {
+		s.toUsers <- &usersMessage{
+			userIDs: []uint{userID},
+			except:  except,
+			message: NewEnvelope(KindReadMarker, roomID, event),
+		}
+
+		s.queueReceipt(roomID, ReadReceipt{
+			UserID:      userID,
+			Username:    username,
+			LastReadSeq: event.LastReadSeq,
+		})
+	}
+
+	return event
+}
+
+// handleRead moves the client's read marker in the frame's room, acknowledging it with
+// the marker's position
+func handleRead(c *WSClient, envelope Envelope) (interface{}, error) {
+	if envelope.RoomID == 0 {
+		return nil, errMissingRoom
+	}
+
+	// The payload is optional, without it the whole room is marked as read
+	var request ReadRequest
+	if len(envelope.Payload) > 0 {
+		err := decodePayload(envelope, &request)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	event, err := c.server.advanceReadMarker(c.userID, c.username, envelope.RoomID, request.Seq, c)
+	if err != nil {
+		return nil, err
+	}
+
+	return AckPayload{Seq: event.LastReadSeq}, nil
+}
+
+// MarkRoomRead is a handler that moves the requester's read marker in a room forward
+func (s *Server) MarkRoomRead(w http.ResponseWriter, r *http.Request) {
+	logger := s.logger.WithField("method", "MarkRoomRead")
+
+	room, _, ok := s.roomFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	// The body is optional, without it the whole room is marked as read
+	var request ReadRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil && err != io.EOF {
+		logger.Errorf("could not unmarshal request body: %s", err.Error())
+		utils.WriteErrorResponse(w, http.StatusBadRequest, err)
+		return
+	}
+
+	userID, username := userFromContext(r.Context())
+	responsePayload, err := s.advanceReadMarker(userID, username, room.ID, request.Seq, nil)
+	if err != nil {
+		writeStatusError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	resp, _ := json.Marshal(&responsePayload)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(resp)
+}
@@ -0,0 +1,114 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/msanatan/go-chatroom/app/models"
+	"github.com/msanatan/go-chatroom/utils"
+)
+
+// receiptFlushInterval is how often the hub sends the read receipts it collected. Reads in
+// between are merged, so a busy room gets at most one receipts event per interval
+const receiptFlushInterval = 2 * time.Second
+
+// receiptUpdate is a user's read marker moving in a room
+type receiptUpdate struct {
+	roomID  uint
+	receipt ReadReceipt
+}
+
+// queueReceipt hands a moved read marker to the hub, to be sent with the room's next receipts
+func (s *Server) queueReceipt(roomID uint, receipt ReadReceipt) {
+	s.receipts <- &receiptUpdate{
+		roomID:  roomID,
+		receipt: receipt,
+	}
+}
+
+// collectReceipt holds a read receipt until the next flush, keeping only the user's latest one
+func (s *Server) collectReceipt(update *receiptUpdate) {
+	if s.pendingReceipts[update.roomID] == nil {
+		s.pendingReceipts[update.roomID] = make(map[uint]ReadReceipt)
+	}
+
+	held, ok := s.pendingReceipts[update.roomID][update.receipt.UserID]
+	if !ok || held.LastReadSeq < update.receipt.LastReadSeq {
+		s.pendingReceipts[update.roomID][update.receipt.UserID] = update.receipt
+	}
+}
+
+// flushReceipts sends each room the read receipts collected since the last flush
+func (s *Server) flushReceipts() {
+	for roomID, held := range s.pendingReceipts {
+		var receipts []ReadReceipt
+		for _, receipt := range held {
+			receipts = append(receipts, receipt)
+		}
+
+		sort.Slice(receipts, func(i, j int) bool {
+			return receipts[i].UserID < receipts[j].UserID
+		})
+
+		s.broadcastToClients(NewEnvelope(KindReceipts, roomID, ReceiptsEvent{Receipts: receipts}))
+		delete(s.pendingReceipts, roomID)
+	}
+}
+
+// GetReceipts is a handler that lists the members who have read a message
+func (s *Server) GetReceipts(w http.ResponseWriter, r *http.Request) {
+	logger := s.logger.WithField("method", "GetReceipts")
+
+	vars := mux.Vars(r)
+	messageID, err := strconv.ParseUint(vars["id"], 10, 32)
+	if err != nil {
+		logger.Errorf("message ID is not valid: %s", err.Error())
+		utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("message ID is not valid"))
+		return
+	}
+
+	var message models.Message
+	tx := s.chatroomDB.DB.First(&message, messageID)
+	if tx.Error != nil {
+		logger.Errorf("could not find message: %s", tx.Error.Error())
+		utils.WriteErrorResponse(w, http.StatusNotFound, errors.New("no message found with that ID"))
+		return
+	}
+
+	userID, _ := userFromContext(r.Context())
+	_, err = s.findAccessibleRoom(userID, message.RoomID)
+	if err != nil {
+		writeStatusError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	// Members have read every message up to their read marker. The author isn't listed
+	receipts := []ReadReceipt{}
+	tx = s.chatroomDB.DB.Model(&models.RoomMembership{}).
+		Select("room_memberships.user_id, users.username, room_memberships.last_read_seq").
+		Joins("JOIN users ON users.id = room_memberships.user_id").
+		Where("room_memberships.room_id = ? AND room_memberships.status = ? AND room_memberships.last_read_seq >= ?",
+			message.RoomID, models.MembershipActive, message.Seq).
+		Where("room_memberships.user_id <> ?", message.UserID).Order("users.username asc").Scan(&receipts)
+	if tx.Error != nil {
+		logger.Errorf("could not pull receipts: %s", tx.Error.Error())
+		utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("could not pull the receipts for this message"))
+		return
+	}
+
+	responsePayload := ReceiptsPayload{
+		MessageID: message.ID,
+		Receipts:  receipts,
+		Size:      len(receipts),
+	}
+
+	resp, _ := json.Marshal(&responsePayload)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(resp)
+}
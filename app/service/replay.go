@@ -0,0 +1,118 @@
+package service
+
+import (
+	"encoding/json"
+
+	"github.com/msanatan/go-chatroom/app/models"
+)
+
+// maxReplayMessages caps how many missed messages are replayed to a reconnecting
+// client. Clients that missed more are told to reload the room's history instead
+const maxReplayMessages = 500
+
+// replayResult holds the messages a subscription missed while it was away
+type replayResult struct {
+	subscription *Subscription
+	messages     []Envelope
+	lastSeq      uint64
+	truncated    bool
+}
+
+// pendingReplay holds back the live events for a subscription while its replay is loading.
+// A client can leave and rejoin a room before an earlier replay finishes, so results are
+// only accepted from the replay of the subscription that's still waiting
+type pendingReplay struct {
+	subscription *Subscription
+	held         []Envelope
+}
+
+// startReplay holds back live events for a subscription that's catching up,
+// while the messages it missed are loaded
+func (s *Server) startReplay(subscription *Subscription) {
+	if s.pending[subscription.Client] == nil {
+		s.pending[subscription.Client] = make(map[uint]*pendingReplay)
+	}
+
+	s.pending[subscription.Client][subscription.RoomID] = &pendingReplay{subscription: subscription}
+	go s.loadReplay(subscription)
+}
+
+// loadReplay reads the messages a subscription missed from the DB and hands them to the hub
+func (s *Server) loadReplay(subscription *Subscription) {
+	logger := s.logger.WithField("method", "loadReplay")
+	result := &replayResult{
+		subscription: subscription,
+		lastSeq:      subscription.Since,
+	}
+
+	var messages []models.Message
+	// Replies aren't sent to the whole room, so they aren't replayed to it either
+	err := s.chatroomDB.DB.Where("room_id = ? AND seq > ? AND parent_id IS NULL", subscription.RoomID, subscription.Since).
+		Order("seq asc").Limit(maxReplayMessages + 1).Preload("User").Preload("Attachments").Find(&messages).Error
+	if err != nil {
+		logger.Errorf("could not load missed messages: %s", err.Error())
+		result.truncated = true
+	} else if len(messages) > maxReplayMessages {
+		result.truncated = true
+	} else {
+		for _, message := range messages {
+			result.messages = append(result.messages, NewEnvelope(KindMessage, message.RoomID, newMessagePayload(message)))
+			result.lastSeq = message.Seq
+		}
+	}
+
+	s.replayed <- result
+}
+
+// finishReplay sends a subscription the messages it missed, followed by the live
+// events held back while they were loaded, then switches it to live delivery
+func (s *Server) finishReplay(result *replayResult) {
+	client := result.subscription.Client
+	roomID := result.subscription.RoomID
+	replay, ok := s.pending[client][roomID]
+	if !ok || replay.subscription != result.subscription {
+		// The client left the room or disconnected in the meantime,
+		// and may have rejoined it with a replay of its own
+		return
+	}
+
+	s.stopReplay(result.subscription)
+
+	if result.truncated {
+		s.deliver(client, NewEnvelope(KindSystem, roomID, SystemPayload{
+			Event:   SystemReplayTruncated,
+			Message: "too many messages were missed to replay them, reload the room's history",
+		}))
+	}
+
+	for _, message := range result.messages {
+		s.deliver(client, message)
+	}
+
+	for _, message := range replay.held {
+		// Messages saved while the replay was loading may have been read from the DB too
+		if message.Kind == KindMessage && !result.truncated {
+			seq := messageSeq(message)
+			if seq != 0 && seq <= result.lastSeq {
+				continue
+			}
+		}
+
+		s.deliver(client, message)
+	}
+}
+
+// stopReplay stops holding back live events for a subscription
+func (s *Server) stopReplay(subscription *Subscription) {
+	delete(s.pending[subscription.Client], subscription.RoomID)
+	if len(s.pending[subscription.Client]) == 0 {
+		delete(s.pending, subscription.Client)
+	}
+}
+
+// messageSeq reads the sequence number of a message envelope
+func messageSeq(envelope Envelope) uint64 {
+	var message MessagePayload
+	json.Unmarshal(envelope.Payload, &message)
+	return message.Seq
+}
@@ -0,0 +1,301 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/msanatan/go-chatroom/app/models"
+	"github.com/msanatan/go-chatroom/app/storage"
+	"github.com/msanatan/go-chatroom/utils"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// What happens to messages that outlive the retention policy
+const (
+	// RetentionDelete removes them for good
+	RetentionDelete = "delete"
+	// RetentionArchive moves them to the archived_messages table
+	RetentionArchive = "archive"
+)
+
+// retentionBatchSize is how many messages are removed per transaction, so the janitor
+// never holds locks on a busy room for long
+const retentionBatchSize = 500
+
+// RetentionPolicy decides how long messages are kept: messages older than Days, or
+// older than a room's latest Messages messages, are removed. 0 means no limit
+type RetentionPolicy struct {
+	Days     int
+	Messages int
+	Mode     string
+}
+
+// ParseRetentionPolicy reads the site's retention policy from its settings, which are all optional.
+// Without any, messages are kept forever unless a room has a policy of its own
+func ParseRetentionPolicy(days, messages, mode string) (RetentionPolicy, error) {
+	policy := RetentionPolicy{Mode: mode}
+	if policy.Mode == "" {
+		policy.Mode = RetentionDelete
+	}
+
+	if policy.Mode != RetentionDelete && policy.Mode != RetentionArchive {
+		return policy, errors.New("retention mode must be delete or archive")
+	}
+
+	if days != "" {
+		count, err := strconv.Atoi(days)
+		if err != nil || count < 0 {
+			return policy, errors.New("retention days must be a positive number")
+		}
+		policy.Days = count
+	}
+
+	if messages != "" {
+		count, err := strconv.Atoi(messages)
+		if err != nil || count < 0 {
+			return policy, errors.New("retention messages must be a positive number")
+		}
+		policy.Messages = count
+	}
+
+	return policy, nil
+}
+
+// forRoom works out the policy a room follows, which can override either of the site's limits
+func (p RetentionPolicy) forRoom(room models.Room) RetentionPolicy {
+	if room.RetentionDays != nil {
+		p.Days = *room.RetentionDays
+	}
+
+	if room.RetentionMessages != nil {
+		p.Messages = *room.RetentionMessages
+	}
+
+	return p
+}
+
+// Janitor removes the messages that outlived the retention policy
+type Janitor struct {
+	db       *gorm.DB
+	storage  storage.Storage
+	policy   RetentionPolicy
+	interval time.Duration
+	logger   *log.Entry
+}
+
+// NewJanitor creates a janitor that enforces the site's retention policy every interval,
+// deleting the files shared in expired messages from the storage
+func NewJanitor(chatroomDB *models.ChatroomDB, fileStorage storage.Storage, policy RetentionPolicy,
+	interval time.Duration, logger *log.Entry) *Janitor {
+	return &Janitor{
+		db:       chatroomDB.DB,
+		storage:  fileStorage,
+		policy:   policy,
+		interval: interval,
+		logger:   logger.WithField("component", "janitor"),
+	}
+}
+
+// Run sweeps the rooms for expired messages straight away, and then every interval
+func (j *Janitor) Run() {
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+
+	for {
+		removed, err := j.Sweep()
+		if err != nil {
+			j.logger.Errorf("could not remove expired messages: %s", err.Error())
+		} else if removed > 0 {
+			j.logger.Infof("removed %d expired messages", removed)
+		}
+
+		<-ticker.C
+	}
+}
+
+// Sweep removes the expired messages of every room, returning how many it removed
+func (j *Janitor) Sweep() (int64, error) {
+	var rooms []models.Room
+	err := j.db.Select("id", "name", "retention_days", "retention_messages").Order("id asc").Find(&rooms).Error
+	if err != nil {
+		return 0, err
+	}
+
+	var total int64
+	for _, room := range rooms {
+		policy := j.policy.forRoom(room)
+		if policy.Days == 0 && policy.Messages == 0 {
+			continue
+		}
+
+		removed, err := j.expireRoom(room, policy)
+		total += removed
+		if err != nil {
+			return total, err
+		}
+
+		if removed > 0 && policy.Mode == RetentionArchive {
+			j.logger.WithField("room", room.ID).Infof("archived %d expired messages from %s", removed, room.Name)
+		} else if removed > 0 {
+			j.logger.WithField("room", room.ID).Infof("deleted %d expired messages from %s", removed, room.Name)
+		}
+	}
+
+	return total, nil
+}
+
+// expireRoom removes a room's expired messages in batches. When a message that started a
+// thread expires, its replies go with it
+func (j *Janitor) expireRoom(room models.Room, policy RetentionPolicy) (int64, error) {
+	// Messages users deleted are still in the table, so they expire too
+	expired := j.db.Unscoped().Model(&models.Message{}).Where("room_id = ?", room.ID)
+
+	// The count limit keeps the newest messages users can see in the room itself, older
+	// ones expire along with any deleted messages in between. Replies aren't counted
+	keptFrom := j.db.Model(&models.Message{}).Select("seq").
+		Where("room_id = ? AND parent_id IS NULL", room.ID).Order("seq desc").Limit(1).Offset(policy.Messages - 1)
+	switch {
+	case policy.Days > 0 && policy.Messages > 0:
+		expired = expired.Where("created_at < ? OR (parent_id IS NULL AND seq < (?))",
+			time.Now().AddDate(0, 0, -policy.Days), keptFrom)
+	case policy.Days > 0:
+		expired = expired.Where("created_at < ?", time.Now().AddDate(0, 0, -policy.Days))
+	case policy.Messages > 0:
+		expired = expired.Where("parent_id IS NULL AND seq < (?)", keptFrom)
+	default:
+		return 0, nil
+	}
+
+	// The query is run once per batch, so it can't be changed by running it
+	expired = expired.Session(&gorm.Session{})
+
+	var total int64
+	for {
+		var messageIDs []uint
+		err := expired.Order("id asc").Limit(retentionBatchSize).Pluck("id", &messageIDs).Error
+		if err != nil {
+			return total, err
+		}
+
+		if len(messageIDs) == 0 {
+			return total, nil
+		}
+
+		var replyIDs []uint
+		err = j.db.Unscoped().Model(&models.Message{}).Where("parent_id IN ? AND id NOT IN ?", messageIDs, messageIDs).
+			Pluck("id", &replyIDs).Error
+		if err != nil {
+			return total, err
+		}
+
+		messageIDs = append(messageIDs, replyIDs...)
+		err = j.removeMessages(messageIDs, policy.Mode)
+		if err != nil {
+			return total, err
+		}
+		total += int64(len(messageIDs))
+	}
+}
+
+// removeMessages deletes messages along with their reactions, mentions, pins and edit history,
+// first copying them to the archive when the policy keeps them. Archived messages keep their
+// attachments and files, which are only deleted along with messages that aren't archived
+func (j *Janitor) removeMessages(messageIDs []uint, mode string) error {
+	dependents := []interface{}{&models.Reaction{}, &models.Mention{}, &models.Pin{}, &models.MessageEdit{}}
+	var storageKeys []string
+	if mode == RetentionDelete {
+		err := j.db.Model(&models.Attachment{}).Where("message_id IN ?", messageIDs).Pluck("storage_key", &storageKeys).Error
+		if err != nil {
+			return err
+		}
+		dependents = append(dependents, &models.Attachment{})
+	}
+
+	err := j.db.Transaction(func(tx *gorm.DB) error {
+		if mode == RetentionArchive {
+			err := tx.Exec(`INSERT INTO archived_messages
+				(id, room_id, user_id, parent_id, seq, text, type, created_at, edited_at, deleted_at, archived_at)
+				SELECT id, room_id, user_id, parent_id, seq, text, type, created_at, edited_at, deleted_at, ?
+				FROM messages WHERE id IN ? ON CONFLICT (id) DO NOTHING`, time.Now(), messageIDs).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, dependent := range dependents {
+			err := tx.Unscoped().Where("message_id IN ?", messageIDs).Delete(dependent).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		return tx.Unscoped().Where("id IN ?", messageIDs).Delete(&models.Message{}).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	// A file that can't be deleted is only wasted space, so it doesn't stop the sweep
+	for _, key := range storageKeys {
+		err = j.storage.Delete(context.Background(), key)
+		if err != nil {
+			j.logger.Errorf("could not delete expired file %s: %s", key, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// SetRoomRetention is a handler that lets a room's owner override the site's retention policy.
+// Leaving a limit out of the request makes the room follow the site's policy for it again
+func (s *Server) SetRoomRetention(w http.ResponseWriter, r *http.Request) {
+	logger := s.logger.WithField("method", "SetRoomRetention")
+
+	var request RetentionRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		logger.Errorf("could not unmarshal request body: %s", err.Error())
+		utils.WriteErrorResponse(w, http.StatusBadRequest, err)
+		return
+	}
+
+	room, membership, ok := s.roomFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if !membership.IsOwner() {
+		utils.WriteErrorResponse(w, http.StatusForbidden, errors.New("only the room's owner can change how long messages are kept"))
+		return
+	}
+
+	room.RetentionDays = request.Days
+	room.RetentionMessages = request.Messages
+	err = room.Validate()
+	if err != nil {
+		logger.Errorf("room is not valid: %s", err.Error())
+		utils.WriteErrorResponse(w, http.StatusBadRequest, err)
+		return
+	}
+
+	tx := s.chatroomDB.DB.Model(&room).Select("retention_days", "retention_messages").Updates(&room)
+	if tx.Error != nil {
+		logger.Errorf("failed to update room retention: %s", tx.Error.Error())
+		utils.WriteErrorResponse(w, http.StatusBadRequest,
+			errors.New("could not update the room at this time, please try again"))
+		return
+	}
+
+	responsePayload := newRoomPayload(room)
+	responsePayload.Role = membership.Role
+
+	resp, _ := json.Marshal(&responsePayload)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(resp)
+}
@@ -0,0 +1,58 @@
+package service_test
+
+import (
+	"testing"
+
+	"github.com/msanatan/go-chatroom/app/service"
+)
+
+func Test_ParseRetentionPolicy(t *testing.T) {
+	tests := []struct {
+		name     string
+		days     string
+		messages string
+		mode     string
+		expected service.RetentionPolicy
+		valid    bool
+	}{
+		{
+			name:     "testing no policy",
+			expected: service.RetentionPolicy{Mode: service.RetentionDelete},
+			valid:    true,
+		},
+		{
+			name:     "testing both limits",
+			days:     "90",
+			messages: "10000",
+			mode:     "archive",
+			expected: service.RetentionPolicy{Days: 90, Messages: 10000, Mode: service.RetentionArchive},
+			valid:    true,
+		},
+		{
+			name: "testing negative days",
+			days: "-1",
+		},
+		{
+			name:     "testing invalid messages",
+			messages: "lots",
+		},
+		{
+			name: "testing unknown mode",
+			days: "30",
+			mode: "shred",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy, err := service.ParseRetentionPolicy(tt.days, tt.messages, tt.mode)
+			if (err == nil) != tt.valid {
+				t.Fatalf("wrong validity. expected %v but received error %v", tt.valid, err)
+			}
+
+			if tt.valid && policy != tt.expected {
+				t.Errorf("wrong policy. expected %+v but received %+v", tt.expected, policy)
+			}
+		})
+	}
+}
@@ -0,0 +1,212 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"html"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/msanatan/go-chatroom/app/models"
+	"github.com/msanatan/go-chatroom/utils"
+	"gorm.io/gorm"
+)
+
+// Search snippets mark the matched words with these before they're made safe to show as HTML
+const (
+	snippetStart = "\x01"
+	snippetStop  = "\x02"
+)
+
+// searchQuery describes which messages a client is looking for. Before is a message ID
+type searchQuery struct {
+	text   string
+	roomID uint
+	author string
+	from   *time.Time
+	to     *time.Time
+	before uint
+	limit  int
+}
+
+// parseSearchTime reads a search date, either a full RFC 3339 timestamp or a plain day.
+// Plain days start at midnight UTC, or end at the next one when endOfDay is set
+func parseSearchTime(value string, endOfDay bool) (time.Time, error) {
+	date, err := time.Parse(time.RFC3339, value)
+	if err == nil {
+		return date, nil
+	}
+
+	date, err = time.Parse("2006-01-02", value)
+	if err == nil && endOfDay {
+		date = date.Add(24*time.Hour - time.Nanosecond)
+	}
+
+	return date, err
+}
+
+// parseSearchQuery reads the q, roomId, author, from, to, before and limit query parameters
+func parseSearchQuery(values url.Values) (searchQuery, error) {
+	page, err := parsePageQuery(values)
+	if err != nil {
+		return searchQuery{}, err
+	}
+
+	if page.after != 0 {
+		return searchQuery{}, errors.New("search results can only be paged back with before")
+	}
+
+	query := searchQuery{
+		text:   strings.TrimSpace(values.Get("q")),
+		author: strings.ToLower(strings.TrimSpace(values.Get("author"))),
+		before: page.before,
+		limit:  page.limit,
+	}
+
+	if query.text == "" {
+		return query, errors.New("q is needed to search messages")
+	}
+
+	if roomID := values.Get("roomId"); roomID != "" {
+		id, err := strconv.ParseUint(roomID, 10, 32)
+		if err != nil || id == 0 {
+			return query, errors.New("roomId must be a room ID")
+		}
+		query.roomID = uint(id)
+	}
+
+	if from := values.Get("from"); from != "" {
+		date, err := parseSearchTime(from, false)
+		if err != nil {
+			return query, errors.New("from must be a date like 2021-03-14 or 2021-03-14T15:09:26Z")
+		}
+		query.from = &date
+	}
+
+	if to := values.Get("to"); to != "" {
+		date, err := parseSearchTime(to, true)
+		if err != nil {
+			return query, errors.New("to must be a date like 2021-03-14 or 2021-03-14T15:09:26Z")
+		}
+		query.to = &date
+	}
+
+	if query.from != nil && query.to != nil && query.to.Before(*query.from) {
+		return query, errors.New("to can't be before from")
+	}
+
+	return query, nil
+}
+
+// highlight makes a search snippet safe to show as HTML, wrapping the matched words in <mark>
+func highlight(snippet string) string {
+	return strings.NewReplacer(snippetStart, "<mark>", snippetStop, "</mark>").Replace(html.EscapeString(snippet))
+}
+
+// SearchMessages is a handler that finds the messages matching a full text search,
+// newest first, in the rooms the user can see
+func (s *Server) SearchMessages(w http.ResponseWriter, r *http.Request) {
+	logger := s.logger.WithField("method", "SearchMessages")
+
+	query, err := parseSearchQuery(r.URL.Query())
+	if err != nil {
+		logger.Errorf("search query is not valid: %s", err.Error())
+		utils.WriteErrorResponse(w, http.StatusBadRequest, err)
+		return
+	}
+
+	userID, _ := userFromContext(r.Context())
+	if query.roomID != 0 {
+		_, err = s.findAccessibleRoom(userID, query.roomID)
+		if err != nil {
+			writeStatusError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	rooms := visibleRooms(s.chatroomDB.DB.Session(&gorm.Session{NewDB: true}).Model(&models.Room{}).Select("rooms.id"), userID)
+	tsQuery := "websearch_to_tsquery('" + models.SearchConfig + "', ?)"
+	tx := s.chatroomDB.DB.Where("messages.search_vector @@ "+tsQuery, query.text).
+		Where("messages.room_id IN (?)", rooms)
+	if query.roomID != 0 {
+		tx = tx.Where("messages.room_id = ?", query.roomID)
+	}
+	if query.author != "" {
+		tx = tx.Where("messages.user_id IN (SELECT id FROM users WHERE LOWER(username) = ?)", query.author)
+	}
+	if query.from != nil {
+		tx = tx.Where("messages.created_at >= ?", *query.from)
+	}
+	if query.to != nil {
+		tx = tx.Where("messages.created_at <= ?", *query.to)
+	}
+	if query.before != 0 {
+		tx = tx.Where("messages.id < ?", query.before)
+	}
+
+	// Fetch an extra message to find out if there's another page
+	var messages []models.Message
+	tx = tx.Order("messages.id desc").Limit(query.limit + 1).Preload("User").Preload("Room").Preload("Attachments").Find(&messages)
+	if tx.Error != nil {
+		logger.Errorf("could not search messages: %s", tx.Error.Error())
+		utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("could not search messages"))
+		return
+	}
+
+	var nextCursor uint
+	if len(messages) > query.limit {
+		messages = messages[:query.limit]
+		nextCursor = messages[len(messages)-1].ID
+	}
+
+	snippets := make(map[uint]string)
+	if len(messages) > 0 {
+		var messageIDs []uint
+		for _, message := range messages {
+			messageIDs = append(messageIDs, message.ID)
+		}
+
+		var headlines []struct {
+			ID      uint
+			Snippet string
+		}
+		options := "StartSel=" + snippetStart + ", StopSel=" + snippetStop + ", MaxFragments=2, MaxWords=20, MinWords=5"
+		tx = s.chatroomDB.DB.Model(&models.Message{}).
+			Select("id, ts_headline('"+models.SearchConfig+"', text, "+tsQuery+", ?) AS snippet", query.text, options).
+			Where("id IN ?", messageIDs).Scan(&headlines)
+		if tx.Error != nil {
+			logger.Errorf("could not highlight search results: %s", tx.Error.Error())
+		}
+
+		for _, headline := range headlines {
+			snippets[headline.ID] = highlight(headline.Snippet)
+		}
+	}
+
+	results := []SearchResultPayload{}
+	for _, message := range messages {
+		result := SearchResultPayload{
+			Message: newMessagePayload(message),
+			Snippet: snippets[message.ID],
+		}
+		if message.Room != nil {
+			result.RoomName = message.Room.Name
+		}
+
+		results = append(results, result)
+	}
+
+	responsePayload := SearchPayload{
+		Results:    results,
+		Size:       len(results),
+		NextCursor: nextCursor,
+	}
+
+	resp, _ := json.Marshal(&responsePayload)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(resp)
+}
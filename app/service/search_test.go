@@ -0,0 +1,128 @@
+package service_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/msanatan/go-chatroom/app/models"
+	"github.com/msanatan/go-chatroom/app/service"
+)
+
+// resultIDs lists the IDs of the messages in a page of search results, in order
+func resultIDs(page service.SearchPayload) []uint {
+	ids := []uint{}
+	for _, result := range page.Results {
+		ids = append(ids, result.Message.ID)
+	}
+
+	return ids
+}
+
+func Test_SearchMessagesRejectsBadQueries(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+	}{
+		{
+			name:  "testing missing search",
+			query: "?roomId=1",
+		},
+		{
+			name:  "testing blank search",
+			query: "?q=%20%20",
+		},
+		{
+			name:  "testing invalid room",
+			query: "?q=deploy&roomId=general",
+		},
+		{
+			name:  "testing invalid date",
+			query: "?q=deploy&from=yesterday",
+		},
+		{
+			name:  "testing dates out of order",
+			query: "?q=deploy&from=2021-03-14&to=2021-03-01",
+		},
+		{
+			name:  "testing after",
+			query: "?q=deploy&after=10",
+		},
+	}
+
+	wsServer := service.NewServer(nil, nil, nil, "", "/", testLogger)
+	r := mux.NewRouter()
+	r.HandleFunc("/search/messages", wsServer.SearchMessages)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			r.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/search/messages"+tt.query, nil))
+			if recorder.Code != http.StatusBadRequest {
+				t.Errorf("wrong status code. expected %d but received %d", http.StatusBadRequest, recorder.Code)
+			}
+		})
+	}
+}
+
+func Test_SearchFindsVisibleMessagesNewestFirst(t *testing.T) {
+	chatroomDB := testDB(t)
+	wsServer := service.NewServer(nil, chatroomDB, nil, "", "/", testLogger)
+	go wsServer.Run()
+	r := newTestRouter(wsServer)
+
+	alice := createTestUser(t, chatroomDB, "alice")
+	bob := createTestUser(t, chatroomDB, "bob")
+	general := createTestRoom(t, alice, r, "General", models.RoomPublic)
+	secret := createTestRoom(t, alice, r, "Secret", models.RoomPrivate)
+
+	deploying := postTestMessage(t, alice, r, general.ID, "We are deploying the release tonight")
+	postTestMessage(t, alice, r, general.ID, "Lunch anyone?")
+	failed := postTestMessage(t, alice, r, general.ID, "The deploy failed, rolling back")
+	keys := postTestMessage(t, alice, r, secret.ID, "Deploy keys are in the vault")
+
+	// Words are matched by their stem, and bob can't see the private room
+	var page service.SearchPayload
+	serveJSON(t, bob, r, http.MethodGet, "/search/messages?q=deploy", nil, http.StatusOK, &page)
+	if ids := resultIDs(page); fmt.Sprint(ids) != fmt.Sprint([]uint{failed.ID, deploying.ID}) {
+		t.Errorf("was expecting bob to find messages %d and %d but received %v", failed.ID, deploying.ID, ids)
+	}
+
+	if len(page.Results) == 2 && !strings.Contains(page.Results[1].Snippet, "<mark>deploying</mark>") {
+		t.Errorf("was expecting the match to be highlighted but received %q", page.Results[1].Snippet)
+	}
+
+	serveJSON(t, alice, r, http.MethodGet, "/search/messages?q=deploy", nil, http.StatusOK, &page)
+	if page.Size != 3 || page.Results[0].Message.ID != keys.ID || page.Results[0].RoomName != "Secret" {
+		t.Errorf("was expecting alice to find the private room's message first but received %+v", page.Results)
+	}
+
+	serveJSON(t, bob, r, http.MethodGet, "/search/messages?q=deploy&limit=1", nil, http.StatusOK, &page)
+	if ids := resultIDs(page); len(ids) != 1 || ids[0] != failed.ID || page.NextCursor != failed.ID {
+		t.Fatalf("was expecting the first page to be message %d but received %v, next cursor %d", failed.ID, ids, page.NextCursor)
+	}
+
+	serveJSON(t, bob, r, http.MethodGet, fmt.Sprintf("/search/messages?q=deploy&limit=1&before=%d", page.NextCursor),
+		nil, http.StatusOK, &page)
+	if ids := resultIDs(page); len(ids) != 1 || ids[0] != deploying.ID || page.NextCursor != 0 {
+		t.Errorf("was expecting the last page to be message %d but received %v, next cursor %d", deploying.ID, ids, page.NextCursor)
+	}
+
+	serveJSON(t, bob, r, http.MethodGet, "/search/messages?q=deploy&author=BOB", nil, http.StatusOK, &page)
+	if page.Size != 0 {
+		t.Errorf("was expecting bob to have written nothing about deploys but found %v", resultIDs(page))
+	}
+
+	recorder := serveAs(alice, r, http.MethodDelete, fmt.Sprintf("/messages/%d", failed.ID), nil)
+	if recorder.Code != http.StatusNoContent {
+		t.Fatalf("could not delete message %d: %s", failed.ID, recorder.Body.String())
+	}
+
+	serveJSON(t, bob, r, http.MethodGet, "/search/messages?q=deploy", nil, http.StatusOK, &page)
+	if ids := resultIDs(page); len(ids) != 1 || ids[0] != deploying.ID {
+		t.Errorf("was expecting deleted messages to be left out but received %v", ids)
+	}
+}
@@ -5,59 +5,158 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
 	"github.com/msanatan/go-chatroom/app/models"
+	"github.com/msanatan/go-chatroom/app/storage"
 	"github.com/msanatan/go-chatroom/rabbitmq"
 	log "github.com/sirupsen/logrus"
 )
 
 // Server is our hub for all WS clients
 type Server struct {
-	rooms          map[uint]map[*WSClient]bool
-	register       chan *Subscription
-	Deregister     chan *Subscription
-	broadcast      chan MessagePayload
+	clients     map[*WSClient]map[uint]bool
+	rooms       map[uint]map[*WSClient]bool
+	users       map[uint]map[*WSClient]bool
+	register    chan *WSClient
+	Deregister  chan *WSClient
+	subscribe   chan *Subscription
+	unsubscribe chan *Subscription
+	broadcast   chan Envelope
+	direct      chan *clientMessage
+	toUsers     chan *usersMessage
+	evict       chan *eviction
+
+	// pending holds back live events for subscriptions replaying missed messages
+	pending  map[*WSClient]map[uint]*pendingReplay
+	replayed chan *replayResult
+
+	// presence tracks which users are connected to each room
+	presence            map[uint]map[uint]*presenceEntry
+	presenceExpired     chan presenceKey
+	presenceQueries     chan *presenceQuery
+	presenceGracePeriod time.Duration
+
+	// typingUsers tracks who is typing in each room, and when their indicator expires
+	typingUsers   map[uint]map[uint]*typingEntry
+	typing        chan *typingUpdate
+	typingTimeout time.Duration
+
+	// pendingReceipts holds the read receipts for each room until they're flushed
+	pendingReceipts map[uint]map[uint]ReadReceipt
+	receipts        chan *receiptUpdate
+
 	rabbitMQClient *rabbitmq.Client
 	chatroomDB     *models.ChatroomDB
+	storage        storage.Storage
 	jwtSecret      string
 	botSymbol      string
 	logger         *log.Entry
 }
 
 // NewServer instantiates a new server struct
-func NewServer(rabbitMQClient *rabbitmq.Client, chatroomDB *models.ChatroomDB,
+func NewServer(rabbitMQClient *rabbitmq.Client, chatroomDB *models.ChatroomDB, fileStorage storage.Storage,
 	jwtSecret, botSymbol string, logger *log.Entry) *Server {
 	if botSymbol == "" {
 		botSymbol = "/"
 	}
 
 	return &Server{
-		rooms:          make(map[uint]map[*WSClient]bool),
-		register:       make(chan *Subscription),
-		Deregister:     make(chan *Subscription),
-		broadcast:      make(chan MessagePayload),
+		clients:     make(map[*WSClient]map[uint]bool),
+		rooms:       make(map[uint]map[*WSClient]bool),
+		users:       make(map[uint]map[*WSClient]bool),
+		register:    make(chan *WSClient),
+		Deregister:  make(chan *WSClient),
+		subscribe:   make(chan *Subscription),
+		unsubscribe: make(chan *Subscription),
+		broadcast:   make(chan Envelope),
+		direct:      make(chan *clientMessage),
+		toUsers:     make(chan *usersMessage),
+		evict:       make(chan *eviction),
+
+		pending:  make(map[*WSClient]map[uint]*pendingReplay),
+		replayed: make(chan *replayResult),
+
+		presence:            make(map[uint]map[uint]*presenceEntry),
+		presenceExpired:     make(chan presenceKey),
+		presenceQueries:     make(chan *presenceQuery),
+		presenceGracePeriod: defaultPresenceGracePeriod,
+
+		typingUsers:   make(map[uint]map[uint]*typingEntry),
+		typing:        make(chan *typingUpdate),
+		typingTimeout: defaultTypingTimeout,
+
+		pendingReceipts: make(map[uint]map[uint]ReadReceipt),
+		receipts:        make(chan *receiptUpdate),
+
 		rabbitMQClient: rabbitMQClient,
 		chatroomDB:     chatroomDB,
+		storage:        fileStorage,
 		jwtSecret:      jwtSecret,
 		botSymbol:      botSymbol,
 		logger:         logger,
 	}
 }
 
-func (s *Server) registerClient(subscription *Subscription) {
+func (s *Server) registerClient(client *WSClient) {
+	s.clients[client] = make(map[uint]bool)
+	if s.users[client.userID] == nil {
+		s.users[client.userID] = make(map[*WSClient]bool)
+	}
+
+	s.users[client.userID][client] = true
+}
+
+func (s *Server) deregisterClient(client *WSClient) {
+	if _, ok := s.clients[client]; ok {
+		for roomID := range s.clients[client] {
+			s.removeSubscription(&Subscription{
+				Client: client,
+				RoomID: roomID,
+			})
+		}
+
+		delete(s.clients, client)
+		delete(s.users[client.userID], client)
+		if len(s.users[client.userID]) == 0 {
+			delete(s.users, client.userID)
+		}
+
+		close(client.send)
+	}
+}
+
+func (s *Server) addSubscription(subscription *Subscription) {
+	// The client may have been dropped while the request was in flight
+	if _, ok := s.clients[subscription.Client]; !ok {
+		return
+	}
+
+	if s.clients[subscription.Client][subscription.RoomID] {
+		return
+	}
+
 	if s.rooms[subscription.RoomID] == nil {
 		s.rooms[subscription.RoomID] = make(map[*WSClient]bool)
 	}
 
 	s.rooms[subscription.RoomID][subscription.Client] = true
+	s.clients[subscription.Client][subscription.RoomID] = true
+	if subscription.Since != 0 {
+		s.startReplay(subscription)
+	}
+
+	s.userJoined(subscription.Client, subscription.RoomID)
 }
 
-func (s *Server) deregisterClient(subscription *Subscription) {
+func (s *Server) removeSubscription(subscription *Subscription) {
 	if _, ok := s.rooms[subscription.RoomID][subscription.Client]; ok {
 		delete(s.rooms[subscription.RoomID], subscription.Client)
-		close(subscription.Client.send)
+		delete(s.clients[subscription.Client], subscription.RoomID)
+		s.stopReplay(subscription)
+		s.userLeft(subscription.Client, subscription.RoomID)
 
 		// Remove room from active connections in memory
 		if len(s.rooms[subscription.RoomID]) == 0 {
@@ -66,34 +165,101 @@ func (s *Server) deregisterClient(subscription *Subscription) {
 	}
 }
 
-func (s *Server) broadcastToClients(message MessagePayload) {
+// deliver queues a message for a client, dropping the client if it can't keep up
+func (s *Server) deliver(client *WSClient, message Envelope) {
+	if _, ok := s.clients[client]; !ok {
+		return
+	}
+
+	select {
+	case client.send <- message:
+	default:
+		s.deregisterClient(client)
+	}
+}
+
+func (s *Server) broadcastToClients(message Envelope) {
 	for client := range s.rooms[message.RoomID] {
-		select {
-		case client.send <- message:
-		default:
-			s.deregisterClient(&Subscription{
-				Client: client,
-				RoomID: message.RoomID,
-			})
+		// Clients catching up on missed messages get live ones once they're done
+		if replay, ok := s.pending[client][message.RoomID]; ok {
+			replay.held = append(replay.held, message)
+			continue
+		}
+
+		s.deliver(client, message)
+	}
+}
+
+// sendToUsers delivers a message to every connection of the given users,
+// whichever rooms they're subscribed to, unless it's only meant for subscribers
+func (s *Server) sendToUsers(usersMessage *usersMessage) {
+	roomID := usersMessage.message.RoomID
+	for _, userID := range usersMessage.userIDs {
+		for client := range s.users[userID] {
+			if client == usersMessage.except {
+				continue
+			}
+
+			if usersMessage.subscribedOnly {
+				if !s.rooms[roomID][client] {
+					continue
+				}
+
+				if replay, ok := s.pending[client][roomID]; ok {
+					replay.held = append(replay.held, usersMessage.message)
+					continue
+				}
+			}
+
+			s.deliver(client, usersMessage.message)
 		}
 	}
 }
 
 // Run executes our websocket server to accpet its various requests
 func (s *Server) Run() {
+	typingTicker := time.NewTicker(typingSweepInterval)
+	defer typingTicker.Stop()
+	receiptTicker := time.NewTicker(receiptFlushInterval)
+	defer receiptTicker.Stop()
+
 	for {
 		select {
-		case subscription := <-s.register:
-			s.registerClient(subscription)
-		case subscription := <-s.Deregister:
-			s.deregisterClient(subscription)
+		case client := <-s.register:
+			s.registerClient(client)
+		case client := <-s.Deregister:
+			s.deregisterClient(client)
+		case subscription := <-s.subscribe:
+			s.addSubscription(subscription)
+		case subscription := <-s.unsubscribe:
+			s.removeSubscription(subscription)
 		case message := <-s.broadcast:
 			s.broadcastToClients(message)
+		case clientMessage := <-s.direct:
+			s.deliver(clientMessage.client, clientMessage.message)
+		case usersMessage := <-s.toUsers:
+			s.sendToUsers(usersMessage)
+		case eviction := <-s.evict:
+			s.evictUser(eviction)
+		case result := <-s.replayed:
+			s.finishReplay(result)
+		case key := <-s.presenceExpired:
+			s.expirePresence(key)
+		case query := <-s.presenceQueries:
+			query.result <- s.usersInRoom(query.roomID)
+		case update := <-s.typing:
+			s.updateTyping(update)
+		case now := <-typingTicker.C:
+			s.expireTyping(now)
+		case update := <-s.receipts:
+			s.collectReceipt(update)
+		case <-receiptTicker.C:
+			s.flushReceipts()
 		}
 	}
 }
 
-// ClientCount returns the number of connected clients
+// ClientCount returns the number of clients subscribed to a room
 func (s *Server) ClientCount(roomID uint) int {
 	return len(s.rooms[roomID])
 }
@@ -103,15 +269,49 @@ var upgrader = websocket.Upgrader{
 	WriteBufferSize: 4096,
 }
 
-// ServeWs registers a WS client
+// ServeWs registers a WS client. Clients subscribe to rooms with protocol frames,
+// if the URL has a room ID or slug the client is subscribed to that room straight away,
+// replaying any messages after the since query parameter
 func ServeWs(server *Server, clientConfig *ClientConfig, logger *log.Entry) http.HandlerFunc {
 	logger = logger.WithField("method", "ServeWs")
 	return func(w http.ResponseWriter, r *http.Request) {
+		var roomID, since uint64
 		vars := mux.Vars(r)
-		roomID, err := strconv.ParseUint(vars["roomId"], 10, 32)
-		if err != nil {
-			logger.Errorf("room ID is not valid: %s", err.Error())
-			return
+		if vars["roomId"] != "" {
+			var err error
+			roomID, err = strconv.ParseUint(vars["roomId"], 10, 32)
+			if err != nil {
+				logger.Errorf("room ID is not valid: %s", err.Error())
+				return
+			}
+		}
+
+		if vars["slug"] != "" {
+			room, err := server.findRoomBySlug(vars["slug"])
+			if err != nil {
+				writeStatusError(w, http.StatusNotFound, err)
+				return
+			}
+			roomID = uint64(room.ID)
+		}
+
+		// Reconnecting clients pass the last sequence number they saw in the room
+		if sinceParam := r.URL.Query().Get("since"); sinceParam != "" {
+			var err error
+			since, err = strconv.ParseUint(sinceParam, 10, 64)
+			if err != nil {
+				logger.Errorf("since is not valid: %s", err.Error())
+				return
+			}
+		}
+
+		userID, username := userFromContext(r.Context())
+		if roomID != 0 {
+			err := server.joinRoom(userID, uint(roomID))
+			if err != nil {
+				writeStatusError(w, http.StatusForbidden, err)
+				return
+			}
 		}
 
 		conn, err := upgrader.Upgrade(w, r, nil)
@@ -121,16 +321,17 @@ func ServeWs(server *Server, clientConfig *ClientConfig, logger *log.Entry) http
 		}
 
 		logger.Debug("Creating new websocket client")
-		client := NewWSClient(conn, server, clientConfig, logger)
-		subscription := &Subscription{
-			Client: client,
-			RoomID: uint(roomID),
-		}
+		client := NewWSClient(conn, server, clientConfig, userID, username, logger)
 
-		go subscription.writeMessages()
-		go subscription.readMessages()
+		// Register before reading so a client that disconnects straight away
+		// is never left dangling in the hub
+		server.register <- client
+		if roomID != 0 {
+			client.subscribe(uint(roomID), since)
+		}
 
-		server.register <- subscription
+		go client.writeMessages()
+		go client.readMessages()
 	}
 }
 
@@ -153,7 +354,7 @@ func (s *Server) ConsumeRMQ() {
 			continue
 		}
 
-		s.broadcast <- message
+		s.broadcast <- NewEnvelope(KindMessage, message.RoomID, message)
 	}
 }
 
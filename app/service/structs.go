@@ -1,32 +1,327 @@
 package service
 
+import "time"
+
 // MessagePayload is the envelope for messages sent to and from the chat participants
+// Seq is the message's position in its room, clients that reconnect pass the
+// last one they saw to have the messages they missed replayed. ParentID is set on replies.
+// Reactions and thread summaries are only filled in for history
 type MessagePayload struct {
-	Message  string `json:"message"`
-	Type     string `json:"type"`
-	Username string `json:"username"`
-	RoomID   uint   `json:"roomId"`
-	Created  string `json:"created"`
+	ID        uint            `json:"id,omitempty"`
+	Seq       uint64          `json:"seq,omitempty"`
+	Message   string          `json:"message"`
+	Type      string          `json:"type"`
+	Username  string          `json:"username"`
+	RoomID    uint            `json:"roomId"`
+	ParentID  uint            `json:"parentId,omitempty"`
+	Created   string          `json:"created"`
+	Edited    string          `json:"edited,omitempty"`
+	Reactions []ReactionCount `json:"reactions,omitempty"`
+	// Attachments are the files shared with the message, which are uploaded along with it
+	Attachments []AttachmentPayload `json:"attachments,omitempty"`
+	ThreadSummary
+}
+
+// AttachmentPayload describes a file shared in a message. URL downloads it
+// for authenticated users who can read the message's room
+type AttachmentPayload struct {
+	ID          uint   `json:"id"`
+	Filename    string `json:"filename"`
+	ContentType string `json:"contentType"`
+	Size        int64  `json:"size"`
+	URL         string `json:"url"`
+}
+
+// ThreadSummary describes the replies to a message that started a thread
+type ThreadSummary struct {
+	ReplyCount int64  `json:"replyCount,omitempty"`
+	LastReply  string `json:"lastReply,omitempty"`
+}
+
+// ThreadPayload is a page of replies to a message, oldest first
+type ThreadPayload struct {
+	Parent MessagePayload `json:"parent"`
+	MessagesPayload
+}
+
+// ThreadUpdatedEvent tells a room a thread in it got a new reply
+type ThreadUpdatedEvent struct {
+	MessageID uint `json:"messageId"`
+	ThreadSummary
+}
+
+// ReactionCount is how many times a message was reacted to with an emoji
+type ReactionCount struct {
+	Emoji string `json:"emoji"`
+	Count int64  `json:"count"`
+}
+
+// ReactionRequest adds or removes a reaction to a message
+type ReactionRequest struct {
+	MessageID uint   `json:"messageId,omitempty"`
+	Emoji     string `json:"emoji"`
+}
+
+// ReactionEvent tells a room a user added or removed a reaction,
+// along with how many reactions of that emoji the message now has
+type ReactionEvent struct {
+	MessageID uint   `json:"messageId"`
+	Emoji     string `json:"emoji"`
+	Count     int64  `json:"count"`
+	UserID    uint   `json:"userId"`
+	Username  string `json:"username"`
+}
+
+// MessageDeletedEvent tells a room one of its messages was deleted
+type MessageDeletedEvent struct {
+	ID     uint `json:"id"`
+	RoomID uint `json:"roomId"`
 }
 
 // MessagesPayload wrapper around list of messages
-// This envelope is useful for future metadata
+// NextCursor fetches older messages when used as before, and PrevCursor
+// newer ones when used as after. They're left out when there's nothing more
 type MessagesPayload struct {
-	Messages []MessagePayload `json:"messages"`
-	Size     int              `json:"size"`
+	Messages   []MessagePayload `json:"messages"`
+	Size       int              `json:"size"`
+	NextCursor uint             `json:"nextCursor,omitempty"`
+	PrevCursor uint             `json:"prevCursor,omitempty"`
 }
 
 // RoomPayload is the request and response struct for
-// a single room
+// a single room. Members is only listed for direct conversations,
+// and Role is the requester's role in the room
 type RoomPayload struct {
-	ID   uint   `json:"id"`
-	Name string `json:"name"`
+	ID          uint    `json:"id"`
+	Name        string  `json:"name"`
+	Kind        string  `json:"kind"`
+	Visibility  string  `json:"visibility"`
+	Slug        *string `json:"slug,omitempty"`
+	Topic       string  `json:"topic"`
+	Description string  `json:"description"`
+	Archived    bool    `json:"archived"`
+	// RetentionDays and RetentionMessages are only set when the room overrides the site's retention
+	RetentionDays     *int     `json:"retentionDays,omitempty"`
+	RetentionMessages *int     `json:"retentionMessages,omitempty"`
+	Role              string   `json:"role,omitempty"`
+	Members           []string `json:"members,omitempty"`
+	// The room's activity is only filled in for the directory
+	MemberCount   int64           `json:"memberCount"`
+	UnreadCount   int64           `json:"unreadCount"`
+	LastMessage   *MessagePayload `json:"lastMessage,omitempty"`
+	LastMessageAt string          `json:"lastMessageAt,omitempty"`
+}
+
+// DirectConversationRequest lists who the requester wants to talk to privately
+type DirectConversationRequest struct {
+	Usernames []string `json:"usernames"`
 }
 
-// RoomsPayload is a wrapper for a list of rooms
+// RoomsPayload is a wrapper for a page of the room directory.
+// NextOffset fetches the next page, it's left out on the last one
 type RoomsPayload struct {
-	Rooms []RoomPayload `json:"rooms"`
-	Size  int           `json:"size"`
+	Rooms      []RoomPayload `json:"rooms"`
+	Size       int           `json:"size"`
+	NextOffset int           `json:"nextOffset,omitempty"`
+}
+
+// InvitationRequest names the user to invite to a room
+type InvitationRequest struct {
+	Username string `json:"username"`
+}
+
+// InvitationPayload is an invitation to join a private room
+type InvitationPayload struct {
+	Room      RoomPayload `json:"room"`
+	InvitedBy string      `json:"invitedBy"`
+	Created   string      `json:"created"`
+}
+
+// InvitationsPayload is a wrapper for a list of invitations
+type InvitationsPayload struct {
+	Invitations []InvitationPayload `json:"invitations"`
+	Size        int                 `json:"size"`
+}
+
+// MembershipEvent tells a room's users someone joined or was removed from it, or their role changed
+type MembershipEvent struct {
+	Event    string `json:"event"`
+	UserID   uint   `json:"userId"`
+	Username string `json:"username"`
+	Role     string `json:"role,omitempty"`
+}
+
+// RoleRequest gives a member a new role in a room
+type RoleRequest struct {
+	Role string `json:"role"`
+}
+
+// RoomRequest is the details of a new room
+type RoomRequest struct {
+	Name        string `json:"name"`
+	Visibility  string `json:"visibility"`
+	Topic       string `json:"topic"`
+	Description string `json:"description"`
+}
+
+// RoomUpdateRequest changes a room's details. Fields that are left out stay the same
+type RoomUpdateRequest struct {
+	Name        *string `json:"name"`
+	Topic       *string `json:"topic"`
+	Description *string `json:"description"`
+}
+
+// ReadRequest moves a read marker to a message. Without a seq, the room is marked as read up to its latest message
+type ReadRequest struct {
+	Seq uint64 `json:"seq,omitempty"`
+}
+
+// ReadMarkerEvent is where a user got to in a room, and how many messages they have left to read
+type ReadMarkerEvent struct {
+	RoomID      uint   `json:"roomId"`
+	LastReadSeq uint64 `json:"lastReadSeq"`
+	UnreadCount int64  `json:"unreadCount"`
+}
+
+// ReadReceipt is how far a user read in a room
+type ReadReceipt struct {
+	UserID      uint   `json:"userId"`
+	Username    string `json:"username"`
+	LastReadSeq uint64 `json:"lastReadSeq"`
+}
+
+// ReceiptsEvent tells a room some of its members read further
+type ReceiptsEvent struct {
+	Receipts []ReadReceipt `json:"receipts"`
+}
+
+// ReceiptsPayload lists the members who read a message
+type ReceiptsPayload struct {
+	MessageID uint          `json:"messageId"`
+	Receipts  []ReadReceipt `json:"receipts"`
+	Size      int           `json:"size"`
+}
+
+// MentionPayload is a message that mentioned the user. Kind is how they were mentioned:
+// user when they were named, room for @room and here for @here
+type MentionPayload struct {
+	ID       uint           `json:"id,omitempty"`
+	Kind     string         `json:"kind"`
+	RoomName string         `json:"roomName"`
+	Message  MessagePayload `json:"message"`
+}
+
+// MentionsPayload is a page of the user's mentions, newest first.
+// NextCursor fetches older mentions when used as before
+type MentionsPayload struct {
+	Mentions   []MentionPayload `json:"mentions"`
+	Size       int              `json:"size"`
+	NextCursor uint             `json:"nextCursor,omitempty"`
+}
+
+// SearchResultPayload is a message that matched a search. Snippet is HTML, the
+// parts of the message around the matches with the matched words in <mark> tags
+type SearchResultPayload struct {
+	Message  MessagePayload `json:"message"`
+	RoomName string         `json:"roomName"`
+	Snippet  string         `json:"snippet"`
+}
+
+// SearchPayload is a page of search results, newest first.
+// NextCursor fetches older results when used as before
+type SearchPayload struct {
+	Results    []SearchResultPayload `json:"results"`
+	Size       int                   `json:"size"`
+	NextCursor uint                  `json:"nextCursor,omitempty"`
+}
+
+// ArchiveUser is a user in an import archive. Users without an email get a made up one
+type ArchiveUser struct {
+	Username string `json:"username"`
+	Email    string `json:"email"`
+}
+
+// ArchiveRoom is a room in an import archive. Key identifies it within the archive.
+// Direct conversations are made of their members, which channels can list too
+type ArchiveRoom struct {
+	Key         string     `json:"key"`
+	Name        string     `json:"name"`
+	Kind        string     `json:"kind"`
+	Visibility  string     `json:"visibility"`
+	Topic       string     `json:"topic"`
+	Description string     `json:"description"`
+	Owner       string     `json:"owner"`
+	Members     []string   `json:"members"`
+	Created     *time.Time `json:"created"`
+}
+
+// ArchiveMessage is a message in an import archive. Key identifies it within the archive's
+// source, Room is the key of its room and Parent the key of the message it replies to
+type ArchiveMessage struct {
+	Key      string     `json:"key"`
+	Room     string     `json:"room"`
+	Username string     `json:"username"`
+	Text     string     `json:"text"`
+	Type     string     `json:"type"`
+	Parent   string     `json:"parent"`
+	Created  *time.Time `json:"created"`
+	Edited   *time.Time `json:"edited"`
+}
+
+// ImportResult counts what an import added
+type ImportResult struct {
+	UsersCreated     int `json:"usersCreated"`
+	RoomsCreated     int `json:"roomsCreated"`
+	MessagesImported int `json:"messagesImported"`
+	MessagesSkipped  int `json:"messagesSkipped"`
+}
+
+// RetentionRequest overrides a room's retention policy. Limits that are left
+// out follow the site's policy, and 0 keeps messages forever
+type RetentionRequest struct {
+	Days     *int `json:"days"`
+	Messages *int `json:"messages"`
+}
+
+// PinPayload is a pinned message, along with who pinned it and when
+type PinPayload struct {
+	Message  MessagePayload `json:"message"`
+	PinnedBy string         `json:"pinnedBy"`
+	Pinned   string         `json:"pinned"`
+}
+
+// PinsPayload lists a room's pinned messages
+type PinsPayload struct {
+	Pins []PinPayload `json:"pins"`
+	Size int          `json:"size"`
+}
+
+// PresenceUser is a user that's connected to a room
+type PresenceUser struct {
+	ID       uint   `json:"id"`
+	Username string `json:"username"`
+}
+
+// PresencePayload lists the users connected to a room
+type PresencePayload struct {
+	RoomID uint           `json:"roomId"`
+	Users  []PresenceUser `json:"users"`
+	Size   int            `json:"size"`
+}
+
+// PresenceEvent is sent to a room when a user joins or leaves it
+type PresenceEvent struct {
+	Event    string `json:"event"`
+	UserID   uint   `json:"userId"`
+	Username string `json:"username"`
+}
+
+// TypingEvent is sent by clients when their user starts or stops typing,
+// and relayed by the server to the rest of the room
+type TypingEvent struct {
+	UserID   uint   `json:"userId,omitempty"`
+	Username string `json:"username,omitempty"`
+	Typing   bool   `json:"typing"`
 }
 
 // CreateUserResponse is the payload for a successful created user
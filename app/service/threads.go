@@ -0,0 +1,210 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/msanatan/go-chatroom/app/models"
+	"github.com/msanatan/go-chatroom/utils"
+)
+
+// findThreadParent loads the message a reply is for. Threads are one level
+// deep, so replies can't be replied to
+func (s *Server) findThreadParent(parentID, roomID uint) (models.Message, error) {
+	var parent models.Message
+	tx := s.chatroomDB.DB.First(&parent, parentID)
+	if tx.Error != nil || parent.RoomID != roomID {
+		return parent, newStatusError(http.StatusNotFound, "the message you're replying to doesn't exist in this room")
+	}
+
+	if parent.ParentID != nil {
+		return parent, errors.New("you can only reply to messages that aren't replies themselves")
+	}
+
+	return parent, nil
+}
+
+// sendToThread sends an event to everyone taking part in a thread
+func (s *Server) sendToThread(parentID uint, envelope Envelope) error {
+	var participants []uint
+	tx := s.chatroomDB.DB.Model(&models.Message{}).Distinct("user_id").
+		Where("id = ? OR parent_id = ?", parentID, parentID).Pluck("user_id", &participants)
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	// Participants who have since left or been removed are no longer
+	// subscribed to the room, so they don't get private replies
+	s.toUsers <- &usersMessage{
+		userIDs:        participants,
+		subscribedOnly: true,
+		message:        envelope,
+	}
+
+	return nil
+}
+
+// broadcastMessageEvent sends an event about a message to the people who can see it:
+// the whole room, or only the thread's participants when the message is a reply
+func (s *Server) broadcastMessageEvent(message models.Message, envelope Envelope) {
+	if message.ParentID == nil {
+		s.broadcast <- envelope
+		return
+	}
+
+	err := s.sendToThread(*message.ParentID, envelope)
+	if err != nil {
+		s.logger.WithField("method", "broadcastMessageEvent").Errorf("could not find thread participants: %s", err.Error())
+	}
+}
+
+// broadcastReply sends a new reply to everyone taking part in its thread, and
+// tells the room the thread's reply count changed
+func (s *Server) broadcastReply(parent models.Message, reply MessagePayload) {
+	logger := s.logger.WithField("method", "broadcastReply")
+
+	err := s.sendToThread(parent.ID, NewEnvelope(KindMessage, reply.RoomID, reply))
+	if err != nil {
+		logger.Errorf("could not find thread participants: %s", err.Error())
+		return
+	}
+
+	summaries, err := s.findThreadSummaries([]uint{parent.ID})
+	if err != nil {
+		logger.Errorf("could not summarise thread: %s", err.Error())
+		return
+	}
+
+	s.broadcast <- NewEnvelope(KindThreadUpdated, parent.RoomID, ThreadUpdatedEvent{
+		MessageID:     parent.ID,
+		ThreadSummary: summaries[parent.ID],
+	})
+}
+
+// findThreadSummaries counts the replies to each of the given messages
+func (s *Server) findThreadSummaries(messageIDs []uint) (map[uint]ThreadSummary, error) {
+	var rows []struct {
+		ParentID   uint
+		ReplyCount int64
+		LastReply  time.Time
+	}
+	tx := s.chatroomDB.DB.Model(&models.Message{}).
+		Select("parent_id, COUNT(*) AS reply_count, MAX(created_at) AS last_reply").
+		Where("parent_id IN ?", messageIDs).Group("parent_id").Scan(&rows)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+
+	summaries := make(map[uint]ThreadSummary)
+	for _, row := range rows {
+		summaries[row.ParentID] = ThreadSummary{
+			ReplyCount: row.ReplyCount,
+			LastReply:  row.LastReply.Format(time.RFC1123Z),
+		}
+	}
+
+	return summaries, nil
+}
+
+// attachThreadSummaries adds the reply count and last reply time to messages that started threads
+func (s *Server) attachThreadSummaries(messages []MessagePayload) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	var messageIDs []uint
+	for _, message := range messages {
+		messageIDs = append(messageIDs, message.ID)
+	}
+
+	summaries, err := s.findThreadSummaries(messageIDs)
+	if err != nil {
+		return err
+	}
+
+	for i := range messages {
+		messages[i].ThreadSummary = summaries[messages[i].ID]
+	}
+
+	return nil
+}
+
+// GetThread returns a page of the replies to a message, along with the message itself.
+// It takes the same before, after and limit parameters as the room history
+func (s *Server) GetThread(w http.ResponseWriter, r *http.Request) {
+	logger := s.logger.WithField("method", "GetThread")
+
+	vars := mux.Vars(r)
+	messageID, err := strconv.ParseUint(vars["id"], 10, 32)
+	if err != nil {
+		logger.Errorf("message ID is not valid: %s", err.Error())
+		utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("message ID is not valid"))
+		return
+	}
+
+	page, err := parsePageQuery(r.URL.Query())
+	if err != nil {
+		logger.Errorf("page query is not valid: %s", err.Error())
+		utils.WriteErrorResponse(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var parent models.Message
+	tx := s.chatroomDB.DB.Preload("User").Preload("Attachments").First(&parent, messageID)
+	if tx.Error != nil {
+		logger.Errorf("could not find message: %s", tx.Error.Error())
+		utils.WriteErrorResponse(w, http.StatusNotFound, errors.New("no message found with that ID"))
+		return
+	}
+
+	userID, _ := userFromContext(r.Context())
+	_, err = s.findAccessibleRoom(userID, parent.RoomID)
+	if err != nil {
+		writeStatusError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	replies, nextCursor, prevCursor, err := findMessagesPage(s.chatroomDB.DB.Where("parent_id = ?", parent.ID), page)
+	if err != nil {
+		logger.Errorf("could not pull replies: %s", err.Error())
+		utils.WriteErrorResponse(w, http.StatusBadRequest,
+			errors.New("could not pull the replies to this message"))
+		return
+	}
+
+	// The parent goes first so it's decorated along with the replies
+	messagesPayload := []MessagePayload{newMessagePayload(parent)}
+	for _, reply := range replies {
+		messagesPayload = append(messagesPayload, newMessagePayload(reply))
+	}
+
+	err = s.attachReactions(messagesPayload)
+	if err != nil {
+		logger.Errorf("could not pull reactions: %s", err.Error())
+	}
+
+	err = s.attachThreadSummaries(messagesPayload[:1])
+	if err != nil {
+		logger.Errorf("could not pull thread summary: %s", err.Error())
+	}
+
+	repliesPayload := messagesPayload[1:]
+	responsePayload := ThreadPayload{
+		Parent: messagesPayload[0],
+		MessagesPayload: MessagesPayload{
+			Messages:   repliesPayload,
+			Size:       len(repliesPayload),
+			NextCursor: nextCursor,
+			PrevCursor: prevCursor,
+		},
+	}
+
+	resp, _ := json.Marshal(&responsePayload)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(resp)
+}
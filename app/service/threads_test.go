@@ -0,0 +1,41 @@
+package service_test
+
+import (
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/msanatan/go-chatroom/app/service"
+)
+
+func Test_ThreadRepliesOnlyReachSubscribedParticipants(t *testing.T) {
+	wsServer := service.NewServer(nil, nil, nil, "", "/", testLogger)
+	go wsServer.Run()
+
+	alice, closeAlice := dialTestServer(t, wsServer, "/1", 1, "alice")
+	defer closeAlice()
+	readEnvelope(t, alice)
+
+	// alice's other tab follows a different room, and bob took part in the
+	// thread but isn't subscribed to the room anymore
+	aliceTab, closeAliceTab := dialTestServer(t, wsServer, "/2", 1, "alice")
+	defer closeAliceTab()
+	readEnvelope(t, aliceTab)
+	bob, closeBob := dialTestServer(t, wsServer, "/", 2, "bob")
+	defer closeBob()
+
+	reply := service.NewEnvelope(service.KindMessage, 1, service.MessagePayload{Message: "in the thread"})
+	wsServer.SendToParticipants([]uint{1, 2}, reply)
+
+	envelope := readEnvelope(t, alice)
+	if envelope.Kind != service.KindMessage || envelope.RoomID != 1 {
+		t.Errorf("was expecting alice to get the reply but received %+v", envelope)
+	}
+
+	// Frames are delivered in order, so the marker arriving first means the reply never did
+	wsServer.SendToUsers([]uint{1, 2}, service.NewEnvelope(service.KindSystem, 0, nil))
+	for name, conn := range map[string]*websocket.Conn{"alice's other tab": aliceTab, "bob": bob} {
+		if envelope := readEnvelope(t, conn); envelope.Kind != service.KindSystem {
+			t.Errorf("was expecting %s not to get the reply but received %+v", name, envelope)
+		}
+	}
+}
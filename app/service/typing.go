@@ -0,0 +1,115 @@
+package service
+
+import "time"
+
+const (
+	// defaultTypingTimeout is how long a typing indicator lasts without being
+	// refreshed. Clients should resend typing frames while the user keeps typing
+	defaultTypingTimeout = 6 * time.Second
+	// typingSweepInterval is how often the hub looks for expired typing indicators
+	typingSweepInterval = time.Second
+)
+
+// typingUpdate is a user starting or stopping typing in a room
+type typingUpdate struct {
+	client *WSClient
+	roomID uint
+	typing bool
+}
+
+// typingEntry is a user that's currently typing in a room
+type typingEntry struct {
+	username  string
+	expiresAt time.Time
+}
+
+// handleTyping relays a typing indicator to the rest of the room. Typing
+// indicators are never stored and aren't acknowledged
+func handleTyping(c *WSClient, envelope Envelope) (interface{}, error) {
+	var event TypingEvent
+	err := decodePayload(envelope, &event)
+	if err != nil {
+		return nil, err
+	}
+
+	if !c.isSubscribed(envelope.RoomID) {
+		return nil, errNotSubscribed
+	}
+
+	c.server.typing <- &typingUpdate{
+		client: c,
+		roomID: envelope.RoomID,
+		typing: event.Typing,
+	}
+
+	return nil, nil
+}
+
+// updateTyping records when a user's typing indicator expires, relaying it
+// to the room when the user starts or stops typing
+func (s *Server) updateTyping(update *typingUpdate) {
+	userID := update.client.userID
+	_, wasTyping := s.typingUsers[update.roomID][userID]
+
+	if !update.typing {
+		if wasTyping {
+			s.stopTyping(update.roomID, userID)
+		}
+		return
+	}
+
+	// The user may have been removed from the room while the indicator was in flight
+	if !s.rooms[update.roomID][update.client] {
+		return
+	}
+
+	if s.typingUsers[update.roomID] == nil {
+		s.typingUsers[update.roomID] = make(map[uint]*typingEntry)
+	}
+
+	s.typingUsers[update.roomID][userID] = &typingEntry{
+		username:  update.client.username,
+		expiresAt: time.Now().Add(s.typingTimeout),
+	}
+
+	if !wasTyping {
+		s.relayTyping(update.roomID, userID, update.client.username, true)
+	}
+}
+
+// stopTyping clears a user's typing indicator and tells the room
+func (s *Server) stopTyping(roomID, userID uint) {
+	entry := s.typingUsers[roomID][userID]
+	delete(s.typingUsers[roomID], userID)
+	if len(s.typingUsers[roomID]) == 0 {
+		delete(s.typingUsers, roomID)
+	}
+
+	s.relayTyping(roomID, userID, entry.username, false)
+}
+
+// expireTyping stops the typing indicators of users that never sent a stop
+func (s *Server) expireTyping(now time.Time) {
+	for roomID, users := range s.typingUsers {
+		for userID, entry := range users {
+			if now.After(entry.expiresAt) {
+				s.stopTyping(roomID, userID)
+			}
+		}
+	}
+}
+
+// relayTyping sends a typing event to everyone in the room but the typing user
+func (s *Server) relayTyping(roomID, userID uint, username string, typing bool) {
+	message := NewEnvelope(KindTyping, roomID, TypingEvent{
+		UserID:   userID,
+		Username: username,
+		Typing:   typing,
+	})
+
+	for client := range s.rooms[roomID] {
+		if client.userID != userID {
+			s.deliver(client, message)
+		}
+	}
+}
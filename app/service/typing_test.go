@@ -0,0 +1,33 @@
+package service_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/msanatan/go-chatroom/app/service"
+)
+
+func Test_TypingIsRelayedToOthers(t *testing.T) {
+	wsServer := service.NewServer(nil, nil, nil, "", "/", testLogger)
+	go wsServer.Run()
+
+	alice, closeAlice := dialTestServer(t, wsServer, "/1", 1, "alice")
+	defer closeAlice()
+	bob, closeBob := dialTestServer(t, wsServer, "/1", 2, "bob")
+	defer closeBob()
+
+	for _, typing := range []bool{true, false} {
+		alice.WriteJSON(service.NewEnvelope(service.KindTyping, 1, service.TypingEvent{Typing: typing}))
+
+		var envelope service.Envelope
+		for envelope.Kind != service.KindTyping {
+			envelope = readEnvelope(t, bob)
+		}
+
+		var event service.TypingEvent
+		json.Unmarshal(envelope.Payload, &event)
+		if event.Username != "alice" || event.Typing != typing {
+			t.Errorf("was expecting alice's typing to be %v but received %+v", typing, event)
+		}
+	}
+}
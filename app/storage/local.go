@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// LocalStorage keeps files in a directory on the server's disk
+type LocalStorage struct {
+	dir string
+}
+
+// NewLocalStorage stores files in dir, creating it if it doesn't exist
+func NewLocalStorage(dir string) (*LocalStorage, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	return &LocalStorage{dir: dir}, nil
+}
+
+func (l *LocalStorage) path(key string) (string, error) {
+	err := validKey(key)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(l.dir, filepath.FromSlash(key)), nil
+}
+
+// Put writes the file to a temporary file first, so a failed upload never leaves half a file behind
+func (l *LocalStorage) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	path, err := l.path(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return err
+	}
+
+	_, err = io.CopyN(file, r, size)
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+
+	return os.Rename(file.Name(), path)
+}
+
+// Get opens the file under key
+func (l *LocalStorage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	path, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return file, nil
+}
+
+// Delete removes the file under key
+func (l *LocalStorage) Delete(ctx context.Context, key string) error {
+	path, err := l.path(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
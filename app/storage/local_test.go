@@ -0,0 +1,86 @@
+package storage_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/msanatan/go-chatroom/app/storage"
+)
+
+func Test_LocalStorageStoresFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "attachments")
+	if err != nil {
+		t.Fatalf("could not create a directory: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := storage.NewLocalStorage(dir)
+	if err != nil {
+		t.Fatalf("could not create storage: %s", err.Error())
+	}
+
+	testStorageRoundTrip(t, store)
+}
+
+func Test_LocalStorageRejectsBadKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "attachments")
+	if err != nil {
+		t.Fatalf("could not create a directory: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := storage.NewLocalStorage(dir)
+	if err != nil {
+		t.Fatalf("could not create storage: %s", err.Error())
+	}
+
+	for _, key := range []string{"", "/etc/passwd", "../outside", "rooms/../../outside", "rooms//1"} {
+		err = store.Put(context.Background(), key, strings.NewReader("hi"), 2, "text/plain")
+		if err == nil {
+			t.Errorf("expected key %q to be rejected", key)
+		}
+	}
+}
+
+// testStorageRoundTrip checks a storage can save, read and delete a file
+func testStorageRoundTrip(t *testing.T, store storage.Storage) {
+	ctx := context.Background()
+	content := "2021-03-14 15:09:26 ERROR something broke"
+
+	err := store.Put(ctx, "rooms/1/log.txt", strings.NewReader(content), int64(len(content)), "text/plain")
+	if err != nil {
+		t.Fatalf("could not put file: %s", err.Error())
+	}
+
+	file, err := store.Get(ctx, "rooms/1/log.txt")
+	if err != nil {
+		t.Fatalf("could not get file: %s", err.Error())
+	}
+	stored, err := ioutil.ReadAll(file)
+	file.Close()
+	if err != nil {
+		t.Fatalf("could not read file: %s", err.Error())
+	}
+
+	if string(stored) != content {
+		t.Errorf("wrong content. expected %q but received %q", content, string(stored))
+	}
+
+	err = store.Delete(ctx, "rooms/1/log.txt")
+	if err != nil {
+		t.Fatalf("could not delete file: %s", err.Error())
+	}
+
+	_, err = store.Get(ctx, "rooms/1/log.txt")
+	if err != storage.ErrNotFound {
+		t.Errorf("expected deleted file to be gone, received %v", err)
+	}
+
+	err = store.Delete(ctx, "rooms/1/log.txt")
+	if err != nil {
+		t.Errorf("deleting a missing file failed: %s", err.Error())
+	}
+}
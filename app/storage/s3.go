@@ -0,0 +1,207 @@
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Requests to S3 are signed with AWS Signature Version 4
+const (
+	signingAlgorithm = "AWS4-HMAC-SHA256"
+	// unsignedPayload lets uploads be streamed instead of hashed up front
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+	// emptyPayloadHash is the SHA-256 of an empty body
+	emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// S3Config says where an S3 compatible service is, and how to sign in to it
+type S3Config struct {
+	// Endpoint is the service's base URL, like https://s3.eu-west-1.amazonaws.com or http://minio:9000
+	Endpoint        string
+	Region          string
+	Bucket          string
+	AccessKeyID     string
+	SecretAccessKey string
+}
+
+// S3Storage keeps files in a bucket of AWS S3, or of any service with the same API like MinIO.
+// Objects are addressed path style, as {endpoint}/{bucket}/{key}
+type S3Storage struct {
+	config   S3Config
+	endpoint *url.URL
+	client   *http.Client
+}
+
+// NewS3Storage stores files in the configured bucket
+func NewS3Storage(config S3Config) (*S3Storage, error) {
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return nil, errors.New("S3 endpoint must be a URL")
+	}
+
+	if config.Region == "" || config.Bucket == "" {
+		return nil, errors.New("S3 region and bucket are needed")
+	}
+
+	if config.AccessKeyID == "" || config.SecretAccessKey == "" {
+		return nil, errors.New("S3 credentials are needed")
+	}
+
+	return &S3Storage{
+		config:   config,
+		endpoint: endpoint,
+		client:   &http.Client{Timeout: 5 * time.Minute},
+	}, nil
+}
+
+// Put uploads the file as an object
+func (s *S3Storage) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	req, err := s.newRequest(ctx, http.MethodPut, key, io.LimitReader(r, size))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", contentType)
+
+	resp, err := s.do(req, unsignedPayload)
+	if err != nil {
+		return err
+	}
+
+	return resp.Body.Close()
+}
+
+// Get downloads the object under key
+func (s *S3Storage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	req, err := s.newRequest(ctx, http.MethodGet, key, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.do(req, emptyPayloadHash)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+// Delete removes the object under key. S3 doesn't complain about objects that don't exist
+func (s *S3Storage) Delete(ctx context.Context, key string) error {
+	req, err := s.newRequest(ctx, http.MethodDelete, key, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.do(req, emptyPayloadHash)
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return resp.Body.Close()
+}
+
+func (s *S3Storage) newRequest(ctx context.Context, method, key string, body io.Reader) (*http.Request, error) {
+	err := validKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	objectURL := *s.endpoint
+	objectURL.Path = strings.TrimSuffix(objectURL.Path, "/") + "/" + s.config.Bucket + "/" + key
+	objectURL.RawPath = ""
+	return http.NewRequestWithContext(ctx, method, objectURL.String(), body)
+}
+
+// do signs and sends a request, turning error responses into errors
+func (s *S3Storage) do(req *http.Request, payloadHash string) (*http.Response, error) {
+	s.sign(req, payloadHash)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+
+	message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return nil, fmt.Errorf("S3 responded to %s with %s: %s", req.Method, resp.Status, strings.TrimSpace(string(message)))
+}
+
+// sign adds the Signature Version 4 headers to a request, signing its host and all its headers
+func (s *S3Storage) sign(req *http.Request, payloadHash string) {
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.Query().Encode(),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.config.Region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{signingAlgorithm, amzDate, scope, hashHex(canonicalRequest)}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.config.SecretAccessKey), date)
+	key = hmacSHA256(key, s.config.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		signingAlgorithm, s.config.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func hashHex(value string) string {
+	hash := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(hash[:])
+}
+
+func hmacSHA256(key []byte, value string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(value))
+	return mac.Sum(nil)
+}
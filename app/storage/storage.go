@@ -0,0 +1,36 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+)
+
+// ErrNotFound is returned when there's no file stored under a key
+var ErrNotFound = errors.New("file not found")
+
+// Storage keeps the files users upload. Keys are slash separated paths, like rooms/1/abc
+type Storage interface {
+	// Put saves size bytes from r under key, replacing any file that was there
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	// Get opens the file under key. The caller closes it
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete removes the file under key. Deleting a file that doesn't exist isn't an error
+	Delete(ctx context.Context, key string) error
+}
+
+// validKey checks a key can't reach outside of where files are stored
+func validKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, `\`) {
+		return errors.New("storage key is not valid")
+	}
+
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			return errors.New("storage key is not valid")
+		}
+	}
+
+	return nil
+}